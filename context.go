@@ -7,40 +7,57 @@ import (
 
 type context struct {
 	m       map[string]interface{}
+	values  map[interface{}]interface{}
 	misc    match.MiscContext
-	special match.SpecialContext
+	special *match.SpecialContext // a pointer, so that copies share the close stack
 }
 
 func NewContext() *context {
-	return &context{m: map[string]interface{}{}}
+	return &context{
+		m:       map[string]interface{}{},
+		values:  map[interface{}]interface{}{},
+		special: &match.SpecialContext{},
+	}
 }
 
 func (ctx *context) Map() map[string]interface{}    { return ctx.m }
 func (ctx *context) Misc() *match.MiscContext       { return &ctx.misc }
-func (ctx *context) Special() *match.SpecialContext { return &ctx.special }
+func (ctx *context) Special() *match.SpecialContext { return ctx.special }
+
+func (ctx *context) Value(key interface{}) interface{} { return ctx.values[key] }
+func (ctx *context) SetValue(key, val interface{})     { ctx.values[key] = val }
 
 func (ctx context) CopyTo(target match.Context) {
-	// shallow copy
-	*target.Misc() = ctx.misc
-	*target.Special() = ctx.special
+	*target.Misc() = ctx.misc.Clone()
+	*target.Special() = ctx.special.Clone()
 
 	trg := target.Map()
+	for k, val := range ctx.m {
+		trg[k] = copyValue(val)
+	}
 
-	for k, val := range ctx.Map() {
-		// If we want to allow pointers to structs in the map, we have to copy
-		// one level deeper, i.e. instead of copying the pointer, reflect and
-		// copy what it points to.
-		rval := reflect.ValueOf(val)
-		if rval.Kind() == reflect.Ptr {
+	for k, val := range ctx.values {
+		target.SetValue(k, copyValue(val))
+	}
+}
 
-			rv := reflect.New(rval.Type().Elem())
-			rv.Elem().Set(rval.Elem())
-			trg[k] = rv.Interface()
+// copyValue returns a clone of val if it's a match.Cloner, a pointer to a copy
+// of what val points to if it's a pointer, or val itself otherwise.
+func copyValue(val interface{}) interface{} {
+	if c, ok := val.(match.Cloner); ok {
+		return c.Clone()
+	}
 
-		} else {
-			trg[k] = val
-		}
+	// If we want to allow pointers to structs in the map, we have to copy
+	// one level deeper, i.e. instead of copying the pointer, reflect and
+	// copy what it points to.
+	rval := reflect.ValueOf(val)
+	if rval.Kind() == reflect.Ptr && !rval.IsNil() {
+		rv := reflect.New(rval.Type().Elem())
+		rv.Elem().Set(rval.Elem())
+		return rv.Interface()
 	}
+	return val
 }
 
 func (ctx context) Reuse(mch match.Matcher) {
@@ -48,11 +65,13 @@ func (ctx context) Reuse(mch match.Matcher) {
 	ctxcopy := NewContext()
 	ctx.CopyTo(ctxcopy)
 
-	// replace sctx.CloseFn with one that manages rc.usecount - the number of
-	// Listener instances rc serves
+	// rc takes over the close stack, and leaves one that manages
+	// rc.usecount - the number of Listener instances rc serves
 	sctx := ctx.Special()
-	rc := &reusableContext{mch, ctxcopy, sctx.CloseFn, 1}
-	sctx.CloseFn = rc.Close
+	rc := &reusableContext{mch, ctxcopy, sctx.TakeClose(), 1}
+	sctx.PushClose(rc.Close)
 
+	matchers.reuseMu.Lock()
 	matchers.reusable = append(matchers.reusable, rc)
+	matchers.reuseMu.Unlock()
 }
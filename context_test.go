@@ -0,0 +1,230 @@
+package manet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+type keyTestVal struct {
+	n int
+}
+
+func TestKey(t *testing.T) {
+	// same names, but the keys mustn't collide
+	strKey := match.NewKey[string]("foo")
+	otherStrKey := match.NewKey[string]("foo")
+	ptrKey := match.NewKey[*keyTestVal]("foo")
+
+	ctx := NewContext()
+
+	if _, ok := strKey.Get(ctx); ok {
+		t.Error("expected no value in an empty context")
+	}
+
+	strKey.Set(ctx, "bar")
+	ptrKey.Set(ctx, &keyTestVal{1})
+
+	if v, ok := strKey.Get(ctx); !ok || v != "bar" {
+		t.Errorf("expected \"bar\", got %q, %v", v, ok)
+	}
+	if _, ok := otherStrKey.Get(ctx); ok {
+		t.Error("keys with the same name collided")
+	}
+
+	// the compatibility map stays separate
+	ctx.Map()["foo"] = 42
+	if v, ok := strKey.Get(ctx); !ok || v != "bar" {
+		t.Errorf("Map() overwrote a keyed value, got %q, %v", v, ok)
+	}
+
+	// CopyTo copies what pointers point to
+	ctxcopy := NewContext()
+	ctx.CopyTo(ctxcopy)
+
+	p, _ := ptrKey.Get(ctx)
+	pcopy, ok := ptrKey.Get(ctxcopy)
+	if !ok || pcopy == p || pcopy.n != 1 {
+		t.Fatalf("expected a copy of %v, got %v", p, pcopy)
+	}
+
+	pcopy.n = 2
+	if p.n != 1 {
+		t.Error("modifying the copy changed the original")
+	}
+
+	if v, ok := strKey.Get(ctxcopy); !ok || v != "bar" {
+		t.Errorf("expected \"bar\" in the copy, got %q, %v", v, ok)
+	}
+}
+
+type clonerTestVal struct {
+	list []int
+}
+
+func (v *clonerTestVal) Clone() interface{} {
+	return &clonerTestVal{append([]int(nil), v.list...)}
+}
+
+func TestReuseIsolation(t *testing.T) {
+	listKey := match.NewKey[*clonerTestVal]("list")
+
+	base := NewContext()
+	mctx := base.Misc()
+	mctx.IPs = []net.IP{net.ParseIP("127.0.0.1").To4()}
+	mctx.Host = "localhost"
+	mctx.HTTPMux = match.NewServeMux()
+	listKey.Set(base, &clonerTestVal{[]int{1}})
+	base.Map()["val"] = &keyTestVal{1}
+
+	// two listeners reusing the same context
+	rc := &reusableContext{Context: base, usecount: 1}
+	ctx1, ctx2 := NewContext(), NewContext()
+	rc.Apply(nil, match.S_Server, ctx1)
+	rc.Apply(nil, match.S_Server, ctx2)
+
+	// mutate everything in ctx1
+	m1 := ctx1.Misc()
+	m1.IPs[0][3] = 2
+	m1.IPs = append(m1.IPs, net.ParseIP("::1"))
+	m1.Host = "example.com"
+	l1, _ := listKey.Get(ctx1)
+	l1.list[0] = 2
+	ctx1.Map()["val"].(*keyTestVal).n = 2
+
+	for _, ctx := range []match.Context{base, ctx2} {
+		m := ctx.Misc()
+		if len(m.IPs) != 1 || !m.IPs[0].Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("IPs affected by another context: %v", m.IPs)
+		}
+		if m.Host != "localhost" {
+			t.Errorf("Host affected by another context: %s", m.Host)
+		}
+		if m.HTTPMux != mctx.HTTPMux {
+			t.Error("expected HTTPMux to be shared")
+		}
+		if l, _ := listKey.Get(ctx); l.list[0] != 1 {
+			t.Errorf("Cloner value affected by another context: %v", l.list)
+		}
+		if v := ctx.Map()["val"].(*keyTestVal); v.n != 1 {
+			t.Errorf("Map value affected by another context: %d", v.n)
+		}
+	}
+}
+
+func TestCloseStack(t *testing.T) {
+	var order []int
+	push := func(sctx *match.SpecialContext, i int, err error) {
+		sctx.PushClose(func() error {
+			order = append(order, i)
+			return err
+		})
+	}
+
+	sctx := NewContext().Special()
+	push(sctx, 1, fmt.Errorf("one"))
+	push(sctx, 2, nil)
+	push(sctx, 3, fmt.Errorf("three"))
+
+	err := sctx.Close()
+	if fmt.Sprint(order) != "[3 2 1]" {
+		t.Errorf("expected reverse order, got %v", order)
+	}
+	if errs, ok := err.(match.MultiError); !ok || len(errs) != 2 {
+		t.Errorf("expected two aggregated errors, got %v", err)
+	}
+
+	// the stack is emptied
+	order = nil
+	if err := sctx.Close(); err != nil || len(order) != 0 {
+		t.Errorf("expected nothing to close, got %v and %v", err, order)
+	}
+}
+
+func TestListenFailureCleanup(t *testing.T) {
+	time.Sleep(toSleep)
+
+	m := newMultiaddr(t, "/ip4/127.0.0.1/tcp/4327/ws/foo")
+
+	ln, err := Listen(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fails after reusing the /http context of ln
+	if ln2, err := Listen(m); err == nil {
+		ln2.Close()
+		t.Fatal("expected an error")
+	}
+
+	ln.Close()
+
+	// the failure must not hold on to the tcp listener
+	ln, err = Listen(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4327"))
+	if err != nil {
+		t.Fatalf("tcp listener wasn't released: %s", err)
+	}
+	ln.Close()
+}
+
+// legacyCloser sets SpecialContext.CloseFn, like MatchAppliers written before
+// the close stack did.
+type legacyCloser struct {
+	i     int
+	order *[]int
+}
+
+func (l legacyCloser) Match(ma.Multiaddr, int) (int, bool) { return 1, true }
+
+func (l legacyCloser) Apply(_ ma.Multiaddr, _ int, ctx match.Context) error {
+	sctx := ctx.Special()
+	if sctx.CloseFn != nil {
+		return fmt.Errorf("expected CloseFn to start out nil")
+	}
+	sctx.CloseFn = func() error {
+		*l.order = append(*l.order, l.i)
+		return nil
+	}
+	return nil
+}
+
+func TestCloseFn(t *testing.T) {
+	var order []int
+	push := func(sctx *match.SpecialContext, i int) {
+		sctx.PushClose(func() error {
+			order = append(order, i)
+			return nil
+		})
+	}
+
+	ctx := NewContext()
+	sctx := ctx.Special()
+	push(sctx, 1)
+	if err := matchers.apply(legacyCloser{2, &order}, nil, match.S_Client, ctx); err != nil {
+		t.Fatal(err)
+	}
+	push(sctx, 3)
+	if err := matchers.apply(legacyCloser{4, &order}, nil, match.S_Client, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// set outside of Apply, it's still run first
+	sctx.CloseFn = func() error {
+		order = append(order, 5)
+		return nil
+	}
+
+	if err := sctx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(order) != "[5 4 3 2 1]" {
+		t.Errorf("expected CloseFns in the stack order, got %v", order)
+	}
+	if sctx.CloseFn != nil {
+		t.Error("expected Close to clear CloseFn")
+	}
+}
@@ -0,0 +1,105 @@
+package manet
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"text/tabwriter"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// Step is one link of the chain that handles a multiaddr.
+type Step struct {
+	// Segment is the part of the multiaddr passed to the MatchApplier.
+	Segment ma.Multiaddr
+
+	// Name and Type of the MatchApplier, e.g. "TCP" and "impl.TCP".
+	// For a reused context they describe its Matcher.
+	Name string
+	Type string
+
+	// Reused is true, if the segment is handled by a context offered for
+	// reuse by a running listener (e.g. an /http server).
+	Reused bool
+}
+
+// Explanation describes how Dial or Listen would handle a multiaddr.
+type Explanation struct {
+	Addr ma.Multiaddr
+	Side int
+
+	// Steps in the order they would be applied.
+	Steps []Step
+
+	// Rest is the part of Addr no MatchApplier could handle, and Err tells
+	// why. Both are nil, if the whole address can be handled.
+	Rest ma.Multiaddr
+	Err  error
+}
+
+// Explain shows how the registered MatchAppliers would split and handle m on
+// the given side (match.S_Client or match.S_Server), without applying
+// anything. If m can't be handled, the returned Explanation shows how far
+// the chain got and the error is returned as well.
+func Explain(m ma.Multiaddr, side int) (*Explanation, error) {
+	matchers.Lock()
+	defer matchers.Unlock()
+
+	chain, split, err := matchers.buildChain(m, side)
+
+	e := &Explanation{Addr: m, Side: side, Err: err}
+	n := 0
+	for i, mch := range chain {
+		st := Step{Segment: split[i]}
+
+		var t reflect.Type
+		if rc, ok := mch.(*reusableContext); ok {
+			st.Reused = true
+			t = reflect.TypeOf(rc.Matcher)
+		} else {
+			t = reflect.TypeOf(mch)
+		}
+		st.Type = t.String()
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		st.Name = t.Name()
+
+		e.Steps = append(e.Steps, st)
+		n += len(ma.Split(split[i]))
+	}
+
+	if err != nil {
+		e.Rest = ma.Join(ma.Split(m)[n:]...)
+	}
+
+	return e, err
+}
+
+// String formats e as a table with a row per step.
+func (e *Explanation) String() string {
+	var buf bytes.Buffer
+
+	verb := "dial"
+	if e.Side == match.S_Server {
+		verb = "listen"
+	}
+	fmt.Fprintf(&buf, "%s %s\n", verb, e.Addr)
+
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, st := range e.Steps {
+		fmt.Fprintf(w, "  %s\t%s\t%s", st.Segment, st.Name, st.Type)
+		if st.Reused {
+			fmt.Fprint(w, "\treused")
+		}
+		fmt.Fprintln(w)
+	}
+	if e.Err != nil {
+		fmt.Fprintf(w, "  %s\terror: %s\n", e.Rest, e.Err)
+	}
+	w.Flush()
+
+	return buf.String()
+}
@@ -0,0 +1,60 @@
+package manet
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+)
+
+func TestExplain(t *testing.T) {
+	time.Sleep(toSleep)
+
+	m := newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/http/ws/foo")
+	e, err := Explain(m, match.S_Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSteps(t, e, []string{"/ip4/127.0.0.1 IP", "/tcp/4324 TCP", "/http/ws/foo WS"})
+
+	// a running listener offers its /http context for reuse
+	ln, err := Listen(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/http/ws/bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	e, err = Explain(m, match.S_Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSteps(t, e, []string{"/ip4/127.0.0.1/tcp/4324/http httpreuser", "/ws/foo WS"})
+	if !e.Steps[0].Reused || e.Steps[1].Reused {
+		t.Errorf("expected only the first step to be reused:\n%s", e)
+	}
+
+	// partial chains are explained too
+	m = newMultiaddr(t, "/ip4/127.0.0.1/udp/4324")
+	e, err = Explain(m, match.S_Client)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	assertSteps(t, e, []string{"/ip4/127.0.0.1 IP"})
+	if e.Rest.String() != "/udp/4324" || e.Err != err {
+		t.Errorf("expected /udp/4324 to be left with an error, got %s and %v", e.Rest, e.Err)
+	}
+	if s := e.String(); !strings.Contains(s, "/udp/4324") || !strings.Contains(s, err.Error()) {
+		t.Errorf("String() is missing the failure:\n%s", s)
+	}
+}
+
+func assertSteps(t *testing.T, e *Explanation, expected []string) {
+	got := []string{}
+	for _, st := range e.Steps {
+		got = append(got, st.Segment.String()+" "+st.Name)
+	}
+	if strings.Join(got, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected steps %v, got %v", expected, got)
+	}
+}
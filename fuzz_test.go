@@ -0,0 +1,117 @@
+package manet
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	"github.com/Gaboose/go-multiaddr-net/match/impl"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+var fuzzSeeds = []string{
+	"/ws",
+	"/ws/foo",
+	"/http",
+	"/http/ws/foo",
+	"/x-netem",
+	"/x-netem/ws/foo",
+	"/tcp/80",
+	"/dns/localhost",
+	"/ip4/127.0.0.1/ws/foo",
+	"/memory/a",
+	"/memory/a/ws/b",
+	"/memory/a/http/ws/b",
+	"/memory/a/http/http/ws/b",
+	"/memory/a/x-netem/ws/b",
+	"/memory/a/ws/b/memory/c",
+	"/memory/a/ws/b/ws/c",
+	"/memory/a/x-netem/x-netem",
+	"/memory//ws/0",
+}
+
+func init() {
+	if impl.OnionSupported() {
+		fuzzSeeds = append(fuzzSeeds, "/onion/timaq4ygg2iegci7:80/http/ws/foo")
+	}
+}
+
+// parseFuzz parses s, unless it's invalid or has an /onion, which the vendored
+// go-multiaddr panics on without patches/go-multiaddr-onion.patch.
+func parseFuzz(s string) (ma.Multiaddr, bool) {
+	if strings.Contains(s, "/onion") && !impl.OnionSupported() {
+		return nil, false
+	}
+	m, err := ma.NewMultiaddr(s)
+	return m, err == nil
+}
+
+func FuzzBuildChain(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		m, ok := parseFuzz(s)
+		if !ok {
+			return
+		}
+		fuzzBuildChain(m)
+	})
+}
+
+func FuzzBuildChainBytes(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		if m, err := ma.NewMultiaddr(s); err == nil {
+			f.Add(m.Bytes())
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := ma.NewMultiaddrBytes(b)
+		if err != nil {
+			return
+		}
+		fuzzBuildChain(m)
+	})
+}
+
+func fuzzBuildChain(m ma.Multiaddr) {
+	for _, side := range []int{match.S_Client, match.S_Server} {
+		e, _ := Explain(m, side)
+		_ = e.String()
+		CanDial(m)
+		CanListen(m)
+	}
+}
+
+// inProcess are protocols FuzzDialListen may apply without touching the
+// network.
+var inProcess = map[string]bool{"memory": true, "http": true, "ws": true, "x-netem": true}
+
+func FuzzDialListen(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		m, ok := parseFuzz(s)
+		if !ok {
+			return
+		}
+		for _, p := range m.Protocols() {
+			if !inProcess[p.Name] {
+				return
+			}
+		}
+
+		ln, lerr := Listen(m)
+		c, err := Dial(m)
+		if err == nil {
+			c.Close()
+		}
+		if lerr == nil {
+			ln.Close()
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package manet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// Gater decides which connections are allowed. Dial consults it before
+// applying anything and whenever the IPs to connect to become known (after
+// /ip4, /ip6 or /dns, and for targets of proxies like /socks5 before the proxy
+// is asked to connect). Listeners consult it for every accepted connection.
+type Gater interface {
+	// AllowDial is consulted before Dial applies anything to remote.
+	AllowDial(remote ma.Multiaddr) bool
+
+	// AllowResolved is consulted by Dial for each IP, which remote resolved
+	// to. Disallowed IPs are not dialed.
+	AllowResolved(remote ma.Multiaddr, ip net.IP) bool
+
+	// AllowAccept is consulted for each connection accepted by a Listener,
+	// before it's returned from Accept. Disallowed ones are closed.
+	AllowAccept(c Conn) bool
+}
+
+// NameGater is an optional interface of Gaters. Dial consults it for host
+// names, which a proxy resolves instead of Dial, e.g. the target of
+// /socks5/dns/example.com/tcp/80 or /onion. Without it such names are allowed,
+// since their IPs are never known.
+type NameGater interface {
+	AllowName(remote ma.Multiaddr, host string) bool
+}
+
+// Stages, at which a Gater may refuse a connection, see GatedError.
+const (
+	GateDial     = "dial"
+	GateResolved = "resolved"
+	GateName     = "name"
+	GateAccept   = "accept"
+)
+
+// GatedError is returned by Dial, or wrapped in an AcceptError by
+// Listener.Accept, if a Gater refused the connection.
+type GatedError struct {
+	Addr  ma.Multiaddr
+	Stage string
+}
+
+func (e *GatedError) Error() string {
+	return fmt.Sprintf("connection gated on %s: %s", e.Stage, e.Addr)
+}
+
+// Temporary returns true, so that accept loops keep going after a gated
+// connection.
+func (e *GatedError) Temporary() bool { return true }
+
+// SetGater makes Dial and Listen consult g. Listeners keep consulting the
+// Gater, which was set when they were created. A nil g turns gating off.
+func SetGater(g Gater) {
+	matchers.Lock()
+	defer matchers.Unlock()
+
+	matchers.gater = g
+}
+
+// gateResolved removes IPs disallowed by g from mctx and returns a GatedError
+// if none are left.
+func gateResolved(g Gater, remote ma.Multiaddr, mctx *match.MiscContext) error {
+	ips := []net.IP{}
+	for _, ip := range mctx.IPs {
+		if g.AllowResolved(remote, ip) {
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		return &GatedError{remote, GateResolved}
+	}
+
+	mctx.IPs = ips
+	return nil
+}
+
+// gateTarget consults g about the target host of a proxy.
+func gateTarget(g Gater, remote ma.Multiaddr, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !g.AllowResolved(remote, ip) {
+			return &GatedError{remote, GateResolved}
+		}
+		return nil
+	}
+
+	if ng, ok := g.(NameGater); ok && !ng.AllowName(remote, host) {
+		return &GatedError{remote, GateName}
+	}
+	return nil
+}
+
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// CIDRFilter is a Gater refusing dials to and connections from IPs in the
+// given networks.
+type CIDRFilter struct {
+	// networks not to dial
+	Dial []*net.IPNet
+
+	// host names not to have proxies dial, a leading dot matches any
+	// subdomain, e.g. "localhost" or ".internal"
+	DialNames []string
+
+	// networks not to accept connections from
+	Accept []*net.IPNet
+}
+
+func (f CIDRFilter) AllowDial(remote ma.Multiaddr) bool {
+	// IPs are checked by AllowResolved
+	return true
+}
+
+func (f CIDRFilter) AllowResolved(remote ma.Multiaddr, ip net.IP) bool {
+	return !containsIP(f.Dial, ip)
+}
+
+func (f CIDRFilter) AllowName(remote ma.Multiaddr, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, n := range f.DialNames {
+		if host == n || (strings.HasPrefix(n, ".") && strings.HasSuffix(host, n)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f CIDRFilter) AllowAccept(c Conn) bool {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !containsIP(f.Accept, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses networks in CIDR notation, e.g. "10.0.0.0/8".
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// PrivateNets are loopback, link-local and private networks, e.g. to be used
+// as CIDRFilter.Dial. They include the unspecified addresses 0.0.0.0 and ::,
+// since dialing them reaches the local host on Linux.
+var PrivateNets, _ = ParseCIDRs(
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"100.64.0.0/10",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
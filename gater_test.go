@@ -0,0 +1,204 @@
+package manet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match/impl"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+func TestGaterDial(t *testing.T) {
+	time.Sleep(toSleep)
+	defer SetGater(nil)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := netecho("tcp", "127.0.0.1:4324", stop); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324")
+
+	SetGater(CIDRFilter{Dial: PrivateNets})
+	_, err := Dial(m)
+	assertGated(t, err, GateResolved)
+
+	SetGater(denyAll{})
+	_, err = Dial(m)
+	assertGated(t, err, GateDial)
+
+	SetGater(CIDRFilter{Dial: mustParseCIDRs(t, "10.0.0.0/8")})
+	c, err := Dial(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, c, m)
+}
+
+func TestGaterResolved(t *testing.T) {
+	ctx := NewContext()
+	ctx.Misc().IPs = []net.IP{net.ParseIP("10.1.2.3"), net.ParseIP("1.2.3.4")}
+	f := CIDRFilter{Dial: PrivateNets}
+	m := newMultiaddr(t, "/dns/example.com")
+
+	if err := gateResolved(f, m, ctx.Misc()); err != nil {
+		t.Fatal(err)
+	}
+	if ips := ctx.Misc().IPs; len(ips) != 1 || !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+		t.Errorf("expected only the public ip left, got %v", ips)
+	}
+
+	// the unspecified addresses reach the local host
+	for _, ip := range []string{"fe80::1", "0.0.0.0", "0.1.2.3", "::"} {
+		ctx.Misc().IPs = []net.IP{net.ParseIP(ip)}
+		assertGated(t, gateResolved(f, m, ctx.Misc()), GateResolved)
+	}
+}
+
+func TestGaterUnspecified(t *testing.T) {
+	time.Sleep(toSleep)
+	defer SetGater(nil)
+
+	ln, err := Listen(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	SetGater(CIDRFilter{Dial: PrivateNets})
+	for _, s := range []string{"/ip4/0.0.0.0/tcp/4324", "/ip6/::/tcp/4324"} {
+		c, err := Dial(newMultiaddr(t, s))
+		if err == nil {
+			c.Close()
+		}
+		assertGated(t, err, GateResolved)
+	}
+}
+
+func TestGaterAccept(t *testing.T) {
+	time.Sleep(toSleep)
+	defer SetGater(nil)
+
+	SetGater(CIDRFilter{Accept: mustParseCIDRs(t, "127.0.0.0/8")})
+	ln, err := Listen(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	SetGater(nil)
+
+	c, err := Dial(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = ln.Accept()
+	var aerr *AcceptError
+	if !errors.As(err, &aerr) || !aerr.Temporary() {
+		t.Errorf("expected a temporary AcceptError, got %v", err)
+	}
+	assertGated(t, err, GateAccept)
+
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the gated conn to be closed")
+	}
+}
+
+func TestGaterProxied(t *testing.T) {
+	time.Sleep(toSleep)
+	defer SetGater(nil)
+
+	// a proxy, which must not hear of gated targets
+	ln, err := net.Listen("tcp", "127.0.0.1:4324")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	heard := make(chan []byte, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			b, _ := io.ReadAll(c)
+			c.Close()
+			heard <- b
+		}
+	}()
+	if impl.OnionSupported() {
+		defer Register(impl.Onion{SocksAddr: "127.0.0.1:4324"})()
+	}
+
+	SetGater(CIDRFilter{Dial: mustParseCIDRs(t, "10.0.0.0/8"), DialNames: []string{"localhost", ".onion"}})
+
+	cases := []struct {
+		m     string
+		stage string
+	}{
+		{"/ip4/127.0.0.1/tcp/4324/socks5/ip4/10.1.2.3/tcp/80", GateResolved},
+		{"/ip4/127.0.0.1/tcp/4324/http-connect/ip4/10.1.2.3/tcp/80", GateResolved},
+		{"/ip4/127.0.0.1/tcp/4324/socks5/dns/localhost/tcp/80", GateName},
+		{"/ip4/127.0.0.1/tcp/4324/http-connect/dns/LocalHost./tcp/80", GateName},
+		{"/onion/timaq4ygg2iegci7:80", GateName},
+	}
+
+	for _, c := range cases {
+		if strings.HasPrefix(c.m, "/onion") && !impl.OnionSupported() {
+			continue
+		}
+		m := newMultiaddr(t, c.m)
+		_, err := Dial(m)
+		assertGated(t, err, c.stage)
+
+		if strings.HasPrefix(c.m, "/onion") {
+			continue
+		}
+		select {
+		case b := <-heard:
+			if len(b) > 0 {
+				t.Errorf("%s: the proxy was asked %q", m, b)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s: the proxy connection wasn't closed", m)
+		}
+	}
+
+	select {
+	case b := <-heard:
+		t.Errorf("/onion: Tor was dialed and asked %q", b)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type denyAll struct{}
+
+func (denyAll) AllowDial(ma.Multiaddr) bool             { return false }
+func (denyAll) AllowResolved(ma.Multiaddr, net.IP) bool { return false }
+func (denyAll) AllowAccept(Conn) bool                   { return false }
+
+func assertGated(t *testing.T, err error, stage string) {
+	var gerr *GatedError
+	if !errors.As(err, &gerr) {
+		t.Errorf("expected a GatedError on %s, got %v", stage, err)
+		return
+	}
+	if gerr.Stage != stage {
+		t.Errorf("expected a GatedError on %s, got one on %s", stage, gerr.Stage)
+	}
+}
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
@@ -0,0 +1,101 @@
+package manet
+
+import (
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// ApplyCall describes a single MatchApplier.Apply call made by Dial or Listen.
+type ApplyCall struct {
+	Applier match.MatchApplier
+	Segment ma.Multiaddr
+	Side    int
+	Ctx     match.Context
+
+	// Reused is true, if Applier is a context offered for reuse by a running
+	// listener, rather than one of the standard MatchAppliers.
+	Reused bool
+
+	// Duration of the Apply call, set once next returns.
+	Duration time.Duration
+}
+
+// Interceptor wraps MatchApplier.Apply calls. It should call next to run the
+// Apply (or the next Interceptor) and return its error. It may as well veto
+// the step by returning an error without calling next, or replace the result
+// by returning something else.
+//
+// Interceptors run while Dial or Listen hold the registry lock, so they must
+// not call Dial, Listen, Register or Intercept themselves.
+type Interceptor func(call *ApplyCall, next func() error) error
+
+type interceptorEntry struct {
+	ic Interceptor
+}
+
+// Intercept adds ic to the Interceptors invoked by Dial and Listen for every
+// step of a chain. The first added Interceptor is the outermost one.
+// Calling the returned function removes ic.
+func Intercept(ic Interceptor) (remove func()) {
+	matchers.Lock()
+	defer matchers.Unlock()
+
+	e := &interceptorEntry{ic}
+	matchers.interceptors = append(matchers.interceptors, e)
+
+	return func() {
+		matchers.Lock()
+		defer matchers.Unlock()
+
+		ics := matchers.interceptors
+		for i, ie := range ics {
+			if ie == e {
+				matchers.interceptors = append(ics[:i], ics[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// apply calls mch.Apply through the registered Interceptors.
+func (mr *matchreg) apply(mch match.MatchApplier, m ma.Multiaddr, side int, ctx match.Context) error {
+	defer stackCloseFn(ctx.Special())
+
+	if len(mr.interceptors) == 0 {
+		return mch.Apply(m, side, ctx)
+	}
+
+	_, reused := mch.(*reusableContext)
+	call := &ApplyCall{
+		Applier: mch,
+		Segment: m,
+		Side:    side,
+		Ctx:     ctx,
+		Reused:  reused,
+	}
+
+	ics := mr.interceptors
+	var next func(i int) error
+	next = func(i int) error {
+		if i == len(ics) {
+			start := time.Now()
+			err := mch.Apply(m, side, ctx)
+			call.Duration = time.Since(start)
+			return err
+		}
+		return ics[i].ic(call, func() error { return next(i + 1) })
+	}
+
+	return next(0)
+}
+
+// stackCloseFn pushes a CloseFn set by a MatchApplier onto the close stack,
+// so it's run in the order it was set, and the next one starts out nil.
+func stackCloseFn(sctx *match.SpecialContext) {
+	if sctx.CloseFn != nil {
+		sctx.PushClose(sctx.CloseFn)
+		sctx.CloseFn = nil
+	}
+}
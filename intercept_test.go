@@ -0,0 +1,99 @@
+package manet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	"github.com/Gaboose/go-multiaddr-net/match/impl"
+)
+
+func TestIntercept(t *testing.T) {
+	time.Sleep(toSleep)
+
+	var calls []string
+	remove := Intercept(func(call *ApplyCall, next func() error) error {
+		err := next()
+		if call.Duration <= 0 {
+			t.Errorf("%s: expected a duration", call.Segment)
+		}
+		calls = append(calls, fmt.Sprintf("%d %s %v", call.Side, call.Segment, call.Reused))
+		return err
+	})
+
+	ln1, err := Listen(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/http/ws/foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+
+	ln2, err := Listen(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/ws/bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+	go serveecho(ln2)
+
+	c, err := Dial(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/ws/bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	remove()
+
+	expected := []string{
+		"1 /ip4/127.0.0.1 false",
+		"1 /tcp/4324 false",
+		"1 /http false",
+		"1 /ws/foo false",
+		"1 /ip4/127.0.0.1/tcp/4324 true",
+		"1 /ws/bar false",
+		"0 /ip4/127.0.0.1 false",
+		"0 /tcp/4324 false",
+		"0 /ws/bar false",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected calls:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(calls, "\n"))
+	}
+}
+
+func TestInterceptVeto(t *testing.T) {
+	time.Sleep(toSleep)
+
+	errDenied := errors.New("denied")
+	remove := Intercept(func(call *ApplyCall, next func() error) error {
+		if _, ok := call.Applier.(impl.WS); ok && call.Side == match.S_Client {
+			return errDenied
+		}
+		return next()
+	})
+
+	ln, err := Listen(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/ws/foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	_, err = Dial(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/ws/foo"))
+	if err != errDenied {
+		t.Errorf("expected the veto error, got %v", err)
+	}
+
+	remove()
+
+	// replace a failure with success, leaving the chain insufficient
+	remove = Intercept(func(call *ApplyCall, next func() error) error {
+		next()
+		return nil
+	})
+	defer remove()
+
+	_, err = Dial(newMultiaddr(t, "/ip4/127.0.0.1/tcp/1"))
+	if err == nil || !strings.Contains(err.Error(), "insufficient address") {
+		t.Errorf("expected an insufficient address error, got %v", err)
+	}
+}
@@ -18,6 +18,15 @@ type Conn interface {
 	// RemoteMultiaddr returns the remote Multiaddr associated
 	// with this connection
 	RemoteMultiaddr() ma.Multiaddr
+
+	// CloseRead shuts down the reading side of the connection, if the
+	// underlying chain supports it. Returns ErrHalfClose otherwise.
+	CloseRead() error
+
+	// CloseWrite shuts down the writing side of the connection, if the
+	// underlying chain supports it (e.g. /tcp, or /ws, which sends a close
+	// frame). Returns ErrHalfClose otherwise.
+	CloseWrite() error
 }
 
 // A Listener is a generic network listener for stream-oriented protocols.
@@ -0,0 +1,433 @@
+// Package manettest checks that MatchApplier implementations meet the
+// contract expected by manet.Dial and manet.Listen.
+//
+// A protocol package would run the standard battery in its tests like this:
+//
+//	func TestConformance(t *testing.T) {
+//		manettest.Suite{
+//			Applier:  myproto.MyProto{},
+//			Template: "/memory/myproto-%d/myproto",
+//		}.Run(t)
+//	}
+package manettest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	manet "github.com/Gaboose/go-multiaddr-net"
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// Suite is a battery of checks against an address chain, which includes the
+// MatchApplier under test.
+type Suite struct {
+	// Applier under test. If set, Run registers it with manet.Register and
+	// checks that it's part of the chains. Whatever it replaced is registered
+	// again once the test is done.
+	Applier match.MatchApplier
+
+	// Template is a multiaddr to both listen on and dial, with a single %d,
+	// which is replaced by a number unique to each check, e.g.
+	// "/memory/test-%d/ws/foo" or "/ip4/127.0.0.1/tcp/%d".
+	Template string
+
+	// Start is the first number put into Template.
+	Start int
+
+	// Timeout of each blocking operation, zero means five seconds.
+	Timeout time.Duration
+}
+
+// Run runs every check as a subtest of t.
+func (s Suite) Run(t *testing.T) {
+	if s.Applier != nil {
+		t.Cleanup(manet.Register(s.Applier))
+	}
+
+	var n int64 = int64(s.Start) - 1
+	next := func(t *testing.T) ma.Multiaddr {
+		str := fmt.Sprintf(s.Template, atomic.AddInt64(&n, 1))
+		m, err := ma.NewMultiaddr(str)
+		if err != nil {
+			t.Fatalf("bad template %q: %s", s.Template, err)
+		}
+		return m
+	}
+
+	t.Run("Match", func(t *testing.T) { s.testMatch(t, next(t)) })
+	t.Run("Echo", func(t *testing.T) { s.testEcho(t, next(t)) })
+	t.Run("CloseReleases", func(t *testing.T) { s.testCloseReleases(t, next(t)) })
+	t.Run("CloseOrder", func(t *testing.T) { s.testCloseOrder(t, next(t)) })
+	t.Run("DuplicateListen", func(t *testing.T) { s.testDuplicateListen(t, next(t)) })
+	t.Run("DialFailure", func(t *testing.T) { s.testDialFailure(t, next(t)) })
+	t.Run("Reuse", func(t *testing.T) { s.testReuse(t, next(t)) })
+	t.Run("Goroutines", func(t *testing.T) { s.testGoroutines(t, next(t)) })
+}
+
+func (s Suite) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 5 * time.Second
+}
+
+// testMatch checks that the chain can be built on both sides, that Match
+// consumes exactly the segments it's given and that ProtocolLister agrees.
+func (s Suite) testMatch(t *testing.T, m ma.Multiaddr) {
+	for _, side := range []int{match.S_Client, match.S_Server} {
+		e, err := manet.Explain(m, side)
+		if err != nil {
+			t.Fatalf("side %d: %s\n%s", side, err, e)
+		}
+
+		found := false
+		for _, st := range e.Steps {
+			if st.Reused || s.Applier == nil || st.Type != reflect.TypeOf(s.Applier).String() {
+				continue
+			}
+			found = true
+
+			n, ok := s.Applier.Match(st.Segment, side)
+			if want := len(st.Segment.Protocols()); !ok || n != want {
+				t.Errorf("side %d: Match(%s) = %d, %v, but it was given %d protocols", side, st.Segment, n, ok, want)
+			}
+
+			if pl, ok := s.Applier.(match.ProtocolLister); ok {
+				name := st.Segment.Protocols()[0].Name
+				if !contains(pl.Protocols(side), name) {
+					t.Errorf("side %d: Protocols(%d) = %v, which lacks matched %q", side, side, pl.Protocols(side), name)
+				}
+			}
+		}
+
+		if s.Applier != nil && !found {
+			t.Errorf("side %d: %T isn't part of the chain\n%s", side, s.Applier, e)
+		}
+	}
+}
+
+// testEcho checks that data passes both ways and that addresses are set.
+func (s Suite) testEcho(t *testing.T, m ma.Multiaddr) {
+	ln := s.listen(t, m)
+	defer ln.Close()
+
+	if !ln.Multiaddr().Equal(m) {
+		t.Errorf("Listener.Multiaddr() = %s, expected %s", ln.Multiaddr(), m)
+	}
+
+	done := s.serveEcho(t, ln, 1)
+
+	c := s.dial(t, m)
+	if !c.RemoteMultiaddr().Equal(m) {
+		t.Errorf("Conn.RemoteMultiaddr() = %s, expected %s", c.RemoteMultiaddr(), m)
+	}
+	s.assertEcho(t, c, bytes.Repeat([]byte("manettest "), 1000))
+	c.Close()
+
+	s.wait(t, done, "the echo server to finish")
+}
+
+// testCloseReleases checks that a closed conn is noticed by its peer and
+// that a closed listener frees its address.
+func (s Suite) testCloseReleases(t *testing.T, m ma.Multiaddr) {
+	ln := s.listen(t, m)
+
+	accepted := make(chan manet.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c := s.dial(t, m)
+	var sc manet.Conn
+	select {
+	case sc = <-accepted:
+	case <-time.After(s.timeout()):
+		t.Fatal("timed out waiting for Accept")
+	}
+
+	c.Close()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, sc)
+		if err == nil {
+			err = io.EOF
+		}
+		readErr <- err
+	}()
+	select {
+	case <-readErr:
+	case <-time.After(s.timeout()):
+		t.Error("the peer of a closed conn doesn't notice")
+	}
+	sc.Close()
+
+	if err := ln.Close(); err != nil {
+		t.Errorf("Listener.Close() err: %s", err)
+	}
+
+	if c, err := manet.Dial(m); err == nil {
+		// some transports (e.g. /ws on a reused /http server) only fail
+		// once something is read
+		c.SetReadDeadline(time.Now().Add(s.timeout()))
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Error("dialing a closed listener succeeds")
+		}
+		c.Close()
+	}
+
+	ln = s.listen(t, m)
+	ln.Close()
+}
+
+// testCloseOrder checks that closing a listener releases what each step of its
+// chain acquired in reverse, i.e. the steps above before the ones below them,
+// even if some of them are shared through Reuse.
+func (s Suite) testCloseOrder(t *testing.T, m ma.Multiaddr) {
+	var mu sync.Mutex
+	var closed []int
+	steps := 0
+	remove := manet.Intercept(func(call *manet.ApplyCall, next func() error) error {
+		if err := next(); err != nil {
+			return err
+		}
+		i := steps
+		steps++
+		call.Ctx.Special().PushClose(func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			closed = append(closed, i)
+			return nil
+		})
+		return nil
+	})
+	ln, err := manet.Listen(m)
+	remove()
+	if err != nil {
+		t.Fatalf("Listen(%s) err: %s", m, err)
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Errorf("Listener.Close() err: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(closed) != steps {
+		t.Fatalf("%d of %d steps were released: %v", len(closed), steps, closed)
+	}
+	for i, step := range closed {
+		if step != steps-1-i {
+			t.Fatalf("steps were released in the order %v, expected the reverse of how they were applied", closed)
+		}
+	}
+}
+
+// testDuplicateListen checks that an address can't be listened on twice and
+// that a failed attempt doesn't break the first listener.
+func (s Suite) testDuplicateListen(t *testing.T, m ma.Multiaddr) {
+	ln := s.listen(t, m)
+	defer ln.Close()
+
+	if ln2, err := manet.Listen(m); err == nil {
+		ln2.Close()
+		t.Fatalf("listening twice on %s succeeds", m)
+	}
+
+	done := s.serveEcho(t, ln, 1)
+	c := s.dial(t, m)
+	s.assertEcho(t, c, []byte("still there"))
+	c.Close()
+	s.wait(t, done, "the echo server to finish")
+}
+
+// testDialFailure checks that dialing nobody fails.
+func (s Suite) testDialFailure(t *testing.T, m ma.Multiaddr) {
+	c, err := manet.Dial(m)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(s.timeout()))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("dialing %s without a listener succeeds", m)
+	}
+}
+
+// testReuse checks that two /ws listeners share the /http server below them,
+// and that closing one leaves the other working. It's skipped unless the
+// Template ends with /ws.
+func (s Suite) testReuse(t *testing.T, m ma.Multiaddr) {
+	split := ma.Split(m)
+	last := split[len(split)-1]
+	if last.Protocols()[0].Name != "ws" {
+		t.Skip("the template doesn't end with /ws")
+	}
+
+	path, _ := last.ValueForProtocol(last.Protocols()[0].Code)
+	m2 := ma.Join(append(split[:len(split)-1:len(split)-1], newMultiaddr(t, "/ws/"+path+"-reuse"))...)
+
+	ln := s.listen(t, m)
+	defer ln.Close()
+	ln2 := s.listen(t, m2)
+	defer ln2.Close()
+
+	e, err := manet.Explain(m2, match.S_Server)
+	if err != nil {
+		t.Fatalf("%s\n%s", err, e)
+	}
+	if len(e.Steps) == 0 || !e.Steps[0].Reused {
+		t.Errorf("expected %s to reuse the server of %s\n%s", m2, m, e)
+	}
+
+	// both are served
+	for _, l := range []manet.Listener{ln, ln2} {
+		done := s.serveEcho(t, l, 1)
+		c := s.dial(t, l.Multiaddr())
+		s.assertEcho(t, c, []byte("hello"))
+		c.Close()
+		s.wait(t, done, "the echo server to finish")
+	}
+
+	// closing one keeps the shared server up for the other
+	ln.Close()
+	done := s.serveEcho(t, ln2, 1)
+	c := s.dial(t, m2)
+	s.assertEcho(t, c, []byte("still there"))
+	c.Close()
+	s.wait(t, done, "the echo server to finish")
+}
+
+// testGoroutines checks that nothing keeps running after everything is
+// closed, including after failed dials and listens, and after a listener that
+// never accepted anything.
+func (s Suite) testGoroutines(t *testing.T, m ma.Multiaddr) {
+	// before anything is dialed or listened on
+	base := runtime.NumGoroutine()
+
+	if c, err := manet.Dial(m); err == nil {
+		c.Close()
+	}
+	s.assertGoroutines(t, base, "a failed Dial")
+
+	ln := s.listen(t, m)
+	ln.Close()
+	s.assertGoroutines(t, base, "a Listen and Close")
+
+	ln = s.listen(t, m)
+	if ln2, err := manet.Listen(m); err == nil {
+		ln2.Close()
+	}
+	done := s.serveEcho(t, ln, 2)
+	for i := 0; i < 2; i++ {
+		c := s.dial(t, m)
+		s.assertEcho(t, c, []byte("hello"))
+		c.Close()
+	}
+	s.wait(t, done, "the echo server to finish")
+	ln.Close()
+	s.assertGoroutines(t, base, "echoing two conns")
+}
+
+// assertGoroutines waits for the number of goroutines to drop to base.
+func (s Suite) assertGoroutines(t *testing.T, base int, after string) {
+	deadline := time.Now().Add(s.timeout())
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are leaking after %s:\n%s", runtime.NumGoroutine()-base, after, stacks())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s Suite) listen(t *testing.T, m ma.Multiaddr) manet.Listener {
+	ln, err := manet.Listen(m)
+	if err != nil {
+		t.Fatalf("Listen(%s) err: %s", m, err)
+	}
+	return ln
+}
+
+func (s Suite) dial(t *testing.T, m ma.Multiaddr) manet.Conn {
+	c, err := manet.Dial(m)
+	if err != nil {
+		t.Fatalf("Dial(%s) err: %s", m, err)
+	}
+	c.SetDeadline(time.Now().Add(s.timeout()))
+	return c
+}
+
+// serveEcho accepts n conns one by one and echoes them until EOF.
+func (s Suite) serveEcho(t *testing.T, ln manet.Listener, n int) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			c, err := ln.Accept()
+			if err != nil {
+				t.Errorf("Accept() err: %s", err)
+				return
+			}
+			c.SetDeadline(time.Now().Add(s.timeout()))
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+	return done
+}
+
+func (s Suite) assertEcho(t *testing.T, c manet.Conn, msg []byte) {
+	go c.Write(msg)
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("reading the echo err: %s", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("expected %d bytes echoed, got different ones", len(msg))
+	}
+}
+
+func (s Suite) wait(t *testing.T, ch <-chan struct{}, what string) {
+	select {
+	case <-ch:
+	case <-time.After(s.timeout()):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func newMultiaddr(t *testing.T, s string) ma.Multiaddr {
+	m, err := ma.NewMultiaddr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stacks() string {
+	buf := make([]byte, 1<<16)
+	buf = buf[:runtime.Stack(buf, true)]
+	return strings.TrimSpace(string(buf))
+}
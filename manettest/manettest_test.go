@@ -0,0 +1,29 @@
+package manettest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Gaboose/go-multiaddr-net/match/impl"
+)
+
+func TestTCP(t *testing.T) {
+	Suite{Applier: impl.TCP{}, Template: "/ip4/127.0.0.1/tcp/%d", Start: 4350}.Run(t)
+}
+
+func TestMemory(t *testing.T) {
+	Suite{Applier: impl.Memory{}, Template: "/memory/manettest-%d"}.Run(t)
+}
+
+func TestWS(t *testing.T) {
+	Suite{Applier: impl.WS{}, Template: "/memory/manettest-ws-%d/ws/echo"}.Run(t)
+}
+
+func TestNetem(t *testing.T) {
+	Suite{Applier: impl.Netem{}, Template: "/ip4/127.0.0.1/tcp/%d/x-netem/ws/echo", Start: 4360}.Run(t)
+}
+
+func TestProxyProto(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	Suite{Applier: impl.ProxyProto{TrustedProxies: []*net.IPNet{loopback}}, Template: "/ip4/127.0.0.1/tcp/%d/proxyproto/ws/echo", Start: 4370}.Run(t)
+}
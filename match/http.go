@@ -11,11 +11,15 @@ import (
 // ServeMux is copied from the standard "net/http" package at this commit:
 // https://github.com/golang/go/blob/2c12b81739ec2cb85073e125748fcbf5d2febb2c/src/net/http/server.go
 //
-// With the addition of the DeHandle method.
+// With the addition of the DeHandle method and the Conns field.
 type ServeMux struct {
 	mu    sync.RWMutex
 	m     map[string]muxEntry
 	hosts bool // whether any patterns contain hostnames
+
+	// Conns counts connections taken over by handlers (e.g. upgraded to
+	// websockets), so that per IP limits hold across all of them.
+	Conns ConnCounter
 }
 
 type muxEntry struct {
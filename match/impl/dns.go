@@ -8,7 +8,7 @@ import (
 )
 
 func init() {
-	ma.AddProtocol(ma.Protocol{42, -1, "dns", ma.CodeToVarint(42)})
+	ma.AddProtocol(ma.Protocol{Code: 42, Size: -1, Name: "dns", VCode: ma.CodeToVarint(42)})
 }
 
 type DNS struct{}
@@ -23,9 +23,16 @@ func (_ DNS) Match(m ma.Multiaddr, side int) (int, bool) {
 	return 0, false
 }
 
+func (_ DNS) Protocols(side int) []string {
+	return []string{"dns"}
+}
+
 func (_ DNS) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
-	p := m.Protocols()[0]
-	host, _ := m.ValueForProtocol(p.Code)
+	p, err := firstProtocol(m)
+	if err != nil {
+		return err
+	}
+	host := protocolValue(m, p)
 
 	ips, err := net.LookupIP(host)
 	if err != nil {
@@ -0,0 +1,116 @@
+package impl
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// httpConnKey holds the conn, which a request of HTTP.Server came on, in the
+// request's context.
+type httpConnKey struct{}
+
+// peerAddr returns the address of the other end of the conn, which r came on.
+// That's its PeerAddr if it has one, e.g. if it's a balancer's connection
+// under /proxyproto, rather than its RemoteAddr, which r.RemoteAddr is.
+func peerAddr(r *http.Request) net.Addr {
+	c, ok := r.Context().Value(httpConnKey{}).(net.Conn)
+	if !ok {
+		// served by someone else's http.Server
+		addr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		return addr
+	}
+	if pa, ok := c.(interface {
+		PeerAddr() net.Addr
+	}); ok {
+		return pa.PeerAddr()
+	}
+	return c.RemoteAddr()
+}
+
+// forwardedAddr returns the client address of r as told by its header named
+// header, if peer is in trusted. The Forwarded header (RFC 7239) is parsed by
+// its for= values, any other, e.g. X-Forwarded-For, as a comma separated list
+// of IPs. Hops are walked from the nearest one and trusted proxies are
+// skipped, so a client can't pose as another by sending the header itself. It
+// returns nil if peer isn't trusted or the header tells nothing more.
+func forwardedAddr(r *http.Request, peer net.Addr, header string, trusted []*net.IPNet) *net.TCPAddr {
+	if len(trusted) == 0 {
+		return nil
+	}
+
+	ta, ok := peer.(*net.TCPAddr)
+	if !ok || ta == nil || !ipInNets(ta.IP, trusted) {
+		return nil
+	}
+
+	var hops []string
+	if http.CanonicalHeaderKey(header) == "Forwarded" {
+		hops = forwardedFor(r.Header.Values(header))
+	} else {
+		for _, v := range r.Header.Values(header) {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	}
+
+	var addr *net.TCPAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		a := parseHop(strings.TrimSpace(hops[i]))
+		if a == nil {
+			// e.g. "unknown" or an obfuscated identifier, nothing
+			// beyond it can be told
+			break
+		}
+		addr = a
+		if !ipInNets(a.IP, trusted) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwardedFor returns the for= values of Forwarded headers (RFC 7239) in
+// the order of hops.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an IP with an optional port, e.g. 192.0.2.1,
+// 192.0.2.1:80, 2001:db8::1 or [2001:db8::1]:80.
+func parseHop(s string) *net.TCPAddr {
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p < 0 || p > 65535 {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
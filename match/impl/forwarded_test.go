@@ -0,0 +1,58 @@
+package impl
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestForwardedAddr(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trusted := []*net.IPNet{proxies}
+
+	cases := []struct {
+		peer     string
+		name     string // of the trusted header
+		header   http.Header
+		expected string // empty for nil
+	}{
+		// a peer outside trusted can't tell anything
+		{"192.0.2.1:80", "X-Forwarded-For", http.Header{"X-Forwarded-For": {"203.0.113.7"}}, ""},
+		{"10.0.0.1:80", "X-Forwarded-For", http.Header{}, ""},
+
+		{"10.0.0.1:80", "X-Real-IP", http.Header{"X-Real-Ip": {"203.0.113.7"}}, "203.0.113.7:0"},
+		{"10.0.0.1:80", "X-Forwarded-For", http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7", "10.0.0.2"}}, "203.0.113.7:0"},
+		{"10.0.0.1:80", "X-Forwarded-For", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3:0"},
+		{"10.0.0.1:80", "X-Forwarded-For", http.Header{"X-Forwarded-For": {"203.0.113.7, garbage"}}, ""},
+
+		// only the trusted header counts
+		{"10.0.0.1:80", "Forwarded", http.Header{"X-Forwarded-For": {"203.0.113.7"}}, ""},
+		{"10.0.0.1:80", "X-Forwarded-For", http.Header{
+			"Forwarded":       {`for=192.0.2.60;proto=http, For="[2001:db8::1]:4711"`},
+			"X-Forwarded-For": {"203.0.113.7"},
+		}, "203.0.113.7:0"},
+
+		{"10.0.0.1:80", "Forwarded", http.Header{
+			"Forwarded":       {`for=192.0.2.60;proto=http, For="[2001:db8::1]:4711"`},
+			"X-Forwarded-For": {"203.0.113.7"},
+		}, "[2001:db8::1]:4711"},
+		{"10.0.0.1:80", "Forwarded", http.Header{"Forwarded": {"for=192.0.2.60", "for=_hidden"}}, ""},
+		{"10.0.0.1:80", "Forwarded", http.Header{"Forwarded": {"for=192.0.2.60", "for=10.0.0.2:8080"}}, "192.0.2.60:0"},
+	}
+
+	for _, c := range cases {
+		r := &http.Request{Header: c.header}
+		peer, _ := net.ResolveTCPAddr("tcp", c.peer)
+		got := forwardedAddr(r, peer, c.name, trusted)
+
+		if c.expected == "" {
+			if got != nil {
+				t.Errorf("%s %s %v: expected nil, got %s", c.peer, c.name, c.header, got)
+			}
+			continue
+		}
+		if got == nil || got.String() != c.expected {
+			t.Errorf("%s %s %v: expected %s, got %v", c.peer, c.name, c.header, c.expected, got)
+		}
+	}
+}
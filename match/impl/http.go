@@ -1,6 +1,8 @@
 package impl
 
 import (
+	"context"
+	"fmt"
 	"github.com/Gaboose/go-multiaddr-net/match"
 	"net"
 	"net/http"
@@ -23,10 +25,21 @@ func (p HTTP) Match(m ma.Multiaddr, side int) (int, bool) {
 	return 0, false
 }
 
+func (p HTTP) Protocols(side int) []string {
+	if side != match.S_Server {
+		return nil
+	}
+	return []string{"http"}
+}
+
 func (p HTTP) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
 	mctx := ctx.Misc()
 	sctx := ctx.Special()
 
+	if sctx.NetListener == nil {
+		return fmt.Errorf("no listener to serve http on")
+	}
+
 	mctx.HTTPMux = p.Server(sctx.NetListener)
 
 	ctx.Reuse(&httpreuser{ctx.Special().PreAddr})
@@ -35,7 +48,14 @@ func (p HTTP) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
 
 func (p HTTP) Server(ln net.Listener) *match.ServeMux {
 	mux := match.NewServeMux()
-	srv := &http.Server{Handler: mux}
+	srv := &http.Server{
+		Handler: mux,
+		// for /ws to tell the peer of a request from the client, if ln is
+		// e.g. a /proxyproto one
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnKey{}, c)
+		},
+	}
 	go srv.Serve(ln)
 	return mux
 }
@@ -0,0 +1,233 @@
+package impl
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+	"golang.org/x/net/http/httpproxy"
+)
+
+func init() {
+	// a code from the private use range, like /socks5
+	ma.AddProtocol(ma.Protocol{Code: 0x300002, Size: 0, Name: "http-connect", VCode: ma.CodeToVarint(0x300002)})
+}
+
+// HTTPConnect tunnels through an HTTP proxy to the address following
+// /http-connect with a CONNECT request, e.g.
+// /dns/proxy/tcp/3128/http-connect/dns/example.com/tcp/443/ws. The proxy is
+// whatever the chain before /http-connect connects to. It only dials.
+//
+// See ProxyFromEnvironment to take the proxy from HTTPS_PROXY.
+type HTTPConnect struct {
+	// Username and Password authenticate with the proxy with the Basic
+	// scheme, if Username is set.
+	Username string
+	Password string
+
+	// Header holds extra headers of the CONNECT request, e.g. User-Agent.
+	Header http.Header
+
+	// Timeout of the exchange with the proxy. Zero means none.
+	Timeout time.Duration
+}
+
+func (_ HTTPConnect) Match(m ma.Multiaddr, side int) (int, bool) {
+	if side != match.S_Client {
+		return 0, false
+	}
+
+	if ps := m.Protocols(); len(ps) >= 3 && ps[0].Name == "http-connect" && isProxyTarget(ps[1:3]) {
+		return 3, true
+	}
+
+	return 0, false
+}
+
+func (_ HTTPConnect) Protocols(side int) []string {
+	if side != match.S_Client {
+		return nil
+	}
+	return []string{"http-connect"}
+}
+
+func (h HTTPConnect) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
+	if side != match.S_Client {
+		return fmt.Errorf("http-connect can only dial")
+	}
+
+	host, port, err := proxyTarget(m)
+	if err != nil {
+		return err
+	}
+
+	sctx := ctx.Special()
+	if sctx.NetConn == nil {
+		return fmt.Errorf("no connection to an http proxy")
+	}
+
+	if err := gateTarget(sctx, host); err != nil {
+		return err
+	}
+	con, err := h.Connect(sctx.NetConn, host, port)
+	if err != nil {
+		return err
+	}
+
+	sctx.NetConn = con
+	setProxyTarget(ctx.Misc(), host)
+	return nil
+}
+
+// Connect sends a CONNECT request for host and port to the HTTP proxy at the
+// other end of c and returns the tunnelled connection, which wraps c. Its
+// deadlines and half-close are those of c.
+func (h HTTPConnect) Connect(c net.Conn, host string, port int) (net.Conn, error) {
+	hostport := net.JoinHostPort(host, strconv.Itoa(port))
+
+	if h.Timeout > 0 {
+		c.SetDeadline(time.Now().Add(h.Timeout))
+		defer c.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: hostport},
+		Host:   hostport,
+		Header: http.Header{},
+	}
+	for k, v := range h.Header {
+		req.Header[k] = v
+	}
+	if h.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(c); err != nil {
+		return nil, fmt.Errorf("http-connect %s: %s", hostport, err)
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("http-connect %s: %s", hostport, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return nil, fmt.Errorf("http-connect %s: proxy authentication required", hostport)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("http-connect %s: proxy responded %s", hostport, resp.Status)
+	}
+
+	// the target may have spoken right after the response
+	return newBufferedConn(c, br), nil
+}
+
+// bufferedConn reads what br buffered from its net.Conn before the rest.
+// Deadlines and half-close go to the net.Conn.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newBufferedConn(c net.Conn, br *bufio.Reader) *bufferedConn {
+	if br.Buffered() == 0 {
+		return &bufferedConn{c, c}
+	}
+	return &bufferedConn{c, io.MultiReader(br, c)}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseRead() error {
+	if hc, ok := c.Conn.(interface {
+		CloseRead() error
+	}); ok {
+		return hc.CloseRead()
+	}
+	return match.ErrHalfClose
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return hc.CloseWrite()
+	}
+	return match.ErrHalfClose
+}
+
+// ProxyFromEnvironment prefixes m with a hop through the proxy configured by
+// HTTPS_PROXY (or https_proxy) and NO_PROXY, like net/http does for https
+// URLs. E.g. with HTTPS_PROXY=proxy:3128, /dns/example.com/tcp/443/ws becomes
+// /dns/proxy/tcp/3128/http-connect/dns/example.com/tcp/443/ws. A socks5://
+// proxy is put in with /socks5 instead.
+//
+// m is returned as is, if no proxy applies to it, including when it doesn't
+// begin with a host and a tcp port. Credentials in the proxy URL can't be
+// part of a multiaddr, so they're an error rather than silently dropped.
+// Configure them with Register instead.
+func ProxyFromEnvironment(m ma.Multiaddr) (ma.Multiaddr, error) {
+	ps := m.Protocols()
+	if len(ps) < 2 || !isProxyTarget(ps[:2]) {
+		return m, nil
+	}
+
+	target := protocolValue(m, ps[0])
+	port := protocolValue(m, ps[1])
+	u, err := httpproxy.FromEnvironment().ProxyFunc()(&url.URL{
+		Scheme: "https",
+		Host:   net.JoinHostPort(target, port),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return m, nil
+	}
+
+	if u.User != nil {
+		return nil, fmt.Errorf("credentials in proxy URL %s can't be part of a multiaddr, register them instead", u.Redacted())
+	}
+
+	var hop, defPort string
+	switch u.Scheme {
+	case "http":
+		hop, defPort = "http-connect", "80"
+	case "socks5":
+		hop, defPort = "socks5", "1080"
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+
+	proxyPort := u.Port()
+	if proxyPort == "" {
+		proxyPort = defPort
+	}
+
+	hostProto := "dns"
+	if ip := net.ParseIP(u.Hostname()); ip.To4() != nil {
+		hostProto = "ip4"
+	} else if ip != nil {
+		hostProto = "ip6"
+	}
+
+	prefix, err := ma.NewMultiaddr(fmt.Sprintf("/%s/%s/tcp/%s/%s", hostProto, u.Hostname(), proxyPort, hop))
+	if err != nil {
+		return nil, err
+	}
+	return prefix.Encapsulate(m), nil
+}
@@ -24,8 +24,15 @@ func (_ IP) Match(m ma.Multiaddr, side int) (int, bool) {
 	return 0, false
 }
 
+func (_ IP) Protocols(side int) []string {
+	return []string{"ip", "ip4", "ip6"}
+}
+
 func (_ IP) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
-	p := m.Protocols()[0]
+	p, err := firstProtocol(m)
+	if err != nil {
+		return err
+	}
 	name := p.Name
 	s, _ := m.ValueForProtocol(p.Code)
 
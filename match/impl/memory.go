@@ -0,0 +1,186 @@
+package impl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+func init() {
+	ma.AddProtocol(ma.Protocol{Code: 777, Size: -1, Name: "memory", VCode: ma.CodeToVarint(777)})
+}
+
+// Memory handles /memory/<name> addresses, which connect through in-process
+// buffered pipes instead of the network. Listen registers name in a process-local
+// table and Dial connects to whoever is listening on it.
+type Memory struct{}
+
+// DefaultMemoryBacklog is how many dialed connections a memory listener
+// queues until they're accepted. Further dials are refused.
+const DefaultMemoryBacklog = 128
+
+var memTable = struct {
+	sync.Mutex
+	listeners map[string]*memListener
+	dials     int // numbers the local addresses of dialed conns
+}{listeners: map[string]*memListener{}}
+
+func (_ Memory) Match(m ma.Multiaddr, side int) (int, bool) {
+	ps := m.Protocols()
+
+	if len(ps) > 0 && ps[0].Name == "memory" {
+		return 1, true
+	}
+
+	return 0, false
+}
+
+func (_ Memory) Protocols(side int) []string {
+	return []string{"memory"}
+}
+
+func (mem Memory) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
+	p, err := firstProtocol(m)
+	if err != nil {
+		return err
+	}
+	name := protocolValue(m, p)
+
+	sctx := ctx.Special()
+
+	switch side {
+
+	case match.S_Client:
+		con, err := mem.Dial(name)
+		if err != nil {
+			return err
+		}
+		sctx.NetConn = con
+		sctx.PushClose(con.Close)
+		return nil
+
+	case match.S_Server:
+		ln, err := mem.Listen(name)
+		if err != nil {
+			return err
+		}
+		sctx.NetListener = ln
+		sctx.PushClose(ln.Close)
+		return nil
+
+	}
+
+	return fmt.Errorf("incorrect side constant")
+}
+
+// Dial connects to the memory listener registered under name.
+func (_ Memory) Dial(name string) (net.Conn, error) {
+	memTable.Lock()
+	ln := memTable.listeners[name]
+	memTable.dials++
+	laddr := MemoryAddr(fmt.Sprintf("%s#%d", name, memTable.dials))
+	memTable.Unlock()
+
+	if ln == nil {
+		return nil, fmt.Errorf("dial /memory/%s: no listener", name)
+	}
+
+	client, server := memPipe(laddr, ln.addr)
+
+	if err := ln.enqueue(server); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("dial /memory/%s: %s", name, err)
+	}
+	return client, nil
+}
+
+// Listen registers name in the process-local table, until the returned
+// listener is closed.
+func (_ Memory) Listen(name string) (net.Listener, error) {
+	memTable.Lock()
+	defer memTable.Unlock()
+
+	if memTable.listeners[name] != nil {
+		return nil, fmt.Errorf("listen /memory/%s: name is taken", name)
+	}
+
+	ln := &memListener{
+		addr:     MemoryAddr(name),
+		acceptCh: make(chan net.Conn, DefaultMemoryBacklog),
+		closeCh:  make(chan struct{}),
+	}
+	memTable.listeners[name] = ln
+	return ln, nil
+}
+
+// MemoryAddr is the net.Addr of memory connections and listeners.
+type MemoryAddr string
+
+func (a MemoryAddr) Network() string { return "memory" }
+func (a MemoryAddr) String() string  { return string(a) }
+
+type memListener struct {
+	addr     MemoryAddr
+	acceptCh chan net.Conn
+	closeCh  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// enqueue hands c over to Accept, refusing it if the backlog is full.
+func (ln *memListener) enqueue(c net.Conn) error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if ln.closed {
+		return errors.New("listener is closed")
+	}
+
+	select {
+	case ln.acceptCh <- c:
+		return nil
+	default:
+		return errors.New("accept backlog is full")
+	}
+}
+
+func (ln *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.acceptCh:
+		return c, nil
+	case <-ln.closeCh:
+		return nil, errors.New("listener is closed")
+	}
+}
+
+func (ln *memListener) Close() error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if ln.closed {
+		return fmt.Errorf("listener is already closed")
+	}
+	ln.closed = true
+	close(ln.closeCh)
+
+	memTable.Lock()
+	delete(memTable.listeners, string(ln.addr))
+	memTable.Unlock()
+
+	// nobody is going to accept the queued conns
+	for {
+		select {
+		case c := <-ln.acceptCh:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (ln *memListener) Addr() net.Addr { return ln.addr }
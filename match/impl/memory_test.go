@@ -0,0 +1,67 @@
+package impl
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemPipe(t *testing.T) {
+	c1, c2 := memPipe(MemoryAddr("a"), MemoryAddr("b"))
+	defer c1.Close()
+	defer c2.Close()
+
+	// both ends write at once without reading
+	if _, err := c1.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a read times out and may resume
+	buf := make([]byte, 4)
+	c1.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := c1.Read(buf); !isTimeout(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	c1.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(c1, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("expected pong, got %q, %v", buf, err)
+	}
+
+	// a write larger than the buffer blocks until it's read
+	big := bytes.Repeat([]byte("x"), 3*memBufferSize)
+	c2.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, err := c2.Write(big); !isTimeout(err) || n >= len(big) {
+		t.Fatalf("expected a timeout, got %d, %v", n, err)
+	}
+	c2.SetWriteDeadline(time.Time{})
+	io.ReadFull(c2, buf) // ping
+
+	go c2.Write(big)
+	if _, err := io.ReadFull(c1, make([]byte, memBufferSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	// half-close
+	c2.CloseWrite()
+	if _, err := io.Copy(io.Discard, c1); err != nil {
+		t.Fatalf("expected EOF after CloseWrite, got %v", err)
+	}
+	if _, err := c1.Write([]byte("still")); err != nil {
+		t.Fatalf("expected the other direction open, got %v", err)
+	}
+
+	c1.Close()
+	if _, err := c2.Write([]byte("x")); err == nil {
+		t.Error("expected a write to a closed end to fail")
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,253 @@
+package impl
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// memBufferSize is how many bytes a memory connection buffers in each
+// direction before Write blocks.
+const memBufferSize = 64 << 10
+
+// memPipe returns two ends of a buffered, full-duplex in-memory connection.
+// Unlike net.Pipe, writes don't wait for the reader, so both ends may write
+// at the same time like over TCP, e.g. websocket close frames.
+func memPipe(addr1, addr2 net.Addr) (*memConn, *memConn) {
+	b1, b2 := newMemBuffer(), newMemBuffer()
+	c1 := &memConn{r: b1, w: b2, laddr: addr1, raddr: addr2}
+	c2 := &memConn{r: b2, w: b1, laddr: addr2, raddr: addr1}
+	c1.rdl, c1.wdl = newMemDeadline(), newMemDeadline()
+	c2.rdl, c2.wdl = newMemDeadline(), newMemDeadline()
+	return c1, c2
+}
+
+// memConn is one end of a memPipe. It supports deadlines and half-close.
+type memConn struct {
+	r, w         *memBuffer
+	rdl, wdl     *memDeadline
+	laddr, raddr net.Addr
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	return c.r.read(b, c.rdl)
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	return c.w.write(b, c.wdl)
+}
+
+func (c *memConn) Close() error {
+	c.r.closeReader()
+	c.w.closeWriter()
+	return nil
+}
+
+// CloseRead makes the peer's writes fail.
+func (c *memConn) CloseRead() error {
+	c.r.closeReader()
+	return nil
+}
+
+// CloseWrite makes the peer read io.EOF, once it reads what's buffered.
+func (c *memConn) CloseWrite() error {
+	c.w.closeWriter()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *memConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.rdl.set(t)
+	c.wdl.set(t)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.rdl.set(t)
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.wdl.set(t)
+	return nil
+}
+
+// memBuffer holds bytes going in one direction of a memPipe.
+type memBuffer struct {
+	mu      sync.Mutex
+	data    []byte
+	rclosed bool          // the reading end was closed
+	wclosed bool          // the writing end was closed
+	changed chan struct{} // closed and replaced on every change
+}
+
+func newMemBuffer() *memBuffer {
+	return &memBuffer{changed: make(chan struct{})}
+}
+
+// signal wakes up whoever waits on b. Callers must hold b.mu.
+func (b *memBuffer) signal() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *memBuffer) read(p []byte, dl *memDeadline) (int, error) {
+	for {
+		if dl.passed() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		b.mu.Lock()
+		if b.rclosed {
+			b.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(b.data) > 0 {
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.signal()
+			b.mu.Unlock()
+			return n, nil
+		}
+		if b.wclosed {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-dl.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (b *memBuffer) write(p []byte, dl *memDeadline) (int, error) {
+	n := 0
+	for {
+		if dl.passed() {
+			return n, os.ErrDeadlineExceeded
+		}
+
+		b.mu.Lock()
+		if b.wclosed {
+			b.mu.Unlock()
+			return n, net.ErrClosed
+		}
+		if b.rclosed {
+			b.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if free := memBufferSize - len(b.data); free > 0 {
+			k := len(p)
+			if k > free {
+				k = free
+			}
+			b.data = append(b.data, p[:k]...)
+			p = p[k:]
+			n += k
+			b.signal()
+		}
+		if len(p) == 0 {
+			b.mu.Unlock()
+			return n, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-dl.wait():
+			return n, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (b *memBuffer) closeReader() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.rclosed {
+		b.rclosed = true
+		b.data = nil
+		b.signal()
+	}
+}
+
+func (b *memBuffer) closeWriter() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.wclosed {
+		b.wclosed = true
+		b.signal()
+	}
+}
+
+// memDeadline is a channel closed once a deadline passes.
+type memDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newMemDeadline() *memDeadline {
+	return &memDeadline{expired: make(chan struct{})}
+}
+
+// set moves the deadline to t, zero meaning none.
+func (d *memDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // the timer fired, wait until it closes the channel
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.expired:
+		closed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		expired := d.expired
+		d.timer = time.AfterFunc(dur, func() { close(expired) })
+		return
+	}
+
+	if !closed {
+		close(d.expired)
+	}
+}
+
+func (d *memDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+func (d *memDeadline) passed() bool {
+	select {
+	case <-d.wait():
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,331 @@
+package impl
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+func init() {
+	// a code from the private use range, it's not meant to leave a test
+	ma.AddProtocol(ma.Protocol{Code: 0x300000, Size: 0, Name: "x-netem", VCode: ma.CodeToVarint(0x300000)})
+}
+
+var (
+	ErrNetemWrite     = errors.New("netem: injected write failure")
+	ErrNetemTruncated = errors.New("netem: injected truncation")
+)
+
+// Netem emulates a bad network on connections below it in the chain, e.g.
+// /memory/foo/x-netem/ws/bar or /ip4/127.0.0.1/tcp/80/x-netem. Only writes
+// are impaired, so the other direction is only affected if the peer uses
+// Netem too. Configure it with Register, the zero value changes nothing.
+//
+// Each connection makes its random decisions from its own sequence, so a test
+// can replay them. Dialed connections are seeded with Seed, and those a
+// listener accepts with Seed+1, Seed+2 and so on in the order it accepts them.
+type Netem struct {
+	// Latency delays the delivery of every Write, like a long link would.
+	// Write returns as soon as the data is on its way, and the data arrives
+	// in the order it was written. Close waits for it to arrive.
+	Latency time.Duration
+
+	// Jitter adds a random delay in [0, Jitter) to Latency.
+	Jitter time.Duration
+
+	// Bandwidth caps writes in bytes per second. Zero means no cap. Unlike
+	// Latency, it blocks Write, like a sender waiting on a slow link.
+	Bandwidth int
+
+	// WriteFailure is the probability of a Write failing with ErrNetemWrite
+	// without writing anything. The connection stays usable.
+	WriteFailure float64
+
+	// Truncate is the probability of a Write writing only a part of its data
+	// and closing the connection, failing with ErrNetemTruncated.
+	Truncate float64
+
+	Seed int64
+}
+
+func (_ Netem) Match(m ma.Multiaddr, side int) (int, bool) {
+	ps := m.Protocols()
+
+	if len(ps) > 0 && ps[0].Name == "x-netem" {
+		return 1, true
+	}
+
+	return 0, false
+}
+
+func (_ Netem) Protocols(side int) []string {
+	return []string{"x-netem"}
+}
+
+func (n Netem) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
+	sctx := ctx.Special()
+
+	switch side {
+
+	case match.S_Client:
+		if sctx.NetConn == nil {
+			return fmt.Errorf("no connection to emulate a network on")
+		}
+		nc := n.wrap(sctx.NetConn)
+		sctx.NetConn = nc
+		// deliver what's on its way before the conn below is closed
+		sctx.PushClose(func() error {
+			nc.drain()
+			return nil
+		})
+		return nil
+
+	case match.S_Server:
+		if sctx.NetListener == nil {
+			return fmt.Errorf("no listener to emulate a network on")
+		}
+		sctx.NetListener = &netemListener{Listener: sctx.NetListener, netem: n}
+		return nil
+
+	}
+
+	return fmt.Errorf("incorrect side constant")
+}
+
+// Wrap returns c with writes impaired as configured by n.
+func (n Netem) Wrap(c net.Conn) net.Conn {
+	return n.wrap(c)
+}
+
+func (n Netem) wrap(c net.Conn) *netemConn {
+	return n.wrapSeeded(c, n.Seed)
+}
+
+func (n Netem) wrapSeeded(c net.Conn, seed int64) *netemConn {
+	return &netemConn{Conn: c, netem: n, rng: rand.New(rand.NewSource(seed))}
+}
+
+type netemListener struct {
+	net.Listener
+	netem    Netem
+	accepted int64 // atomic, seeds the next accepted conn
+}
+
+func (ln *netemListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddInt64(&ln.accepted, 1)
+	return ln.netem.wrapSeeded(c, ln.netem.Seed+n), nil
+}
+
+// netemGrace is how long Close waits for delayed writes past their delivery
+// time, e.g. while the peer isn't reading.
+const netemGrace = time.Second
+
+type netemConn struct {
+	net.Conn
+	netem Netem
+
+	mu    sync.Mutex // guards everything below
+	rng   *rand.Rand
+	wdl   time.Time // write deadline, to cut delays short
+	queue []netemWrite
+	due   time.Time     // delivery time of the last queued write
+	idle  chan struct{} // closed once the queue is delivered, nil if idle
+	err   error         // of a delivery, returned by the next Write
+}
+
+// netemWrite is a Write on its way to the connection below.
+type netemWrite struct {
+	b     []byte
+	due   time.Time
+	close bool // close the connection after b, i.e. b was truncated
+}
+
+func (c *netemConn) Write(b []byte) (int, error) {
+	fail, trunc, cut, delay, pace, wdl := c.plan(len(b))
+
+	if fail {
+		return 0, ErrNetemWrite
+	}
+
+	if err := sleepUntil(time.Now().Add(pace), wdl); err != nil {
+		return 0, err
+	}
+
+	if trunc {
+		b = b[:cut]
+	}
+	if err := c.send(b, delay, trunc); err != nil {
+		return 0, err
+	}
+	if trunc {
+		return cut, ErrNetemTruncated
+	}
+	return len(b), nil
+}
+
+// plan makes the random decisions for a Write of size bytes. delay is the
+// latency of its delivery, and pace is how long the writer is held up.
+func (c *netemConn) plan(size int) (fail, trunc bool, cut int, delay, pace time.Duration, wdl time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.netem
+	fail = n.WriteFailure > 0 && c.rng.Float64() < n.WriteFailure
+	trunc = n.Truncate > 0 && c.rng.Float64() < n.Truncate
+	if trunc {
+		cut = c.rng.Intn(size + 1)
+	}
+
+	delay = n.Latency
+	if n.Jitter > 0 {
+		delay += time.Duration(c.rng.Int63n(int64(n.Jitter)))
+	}
+	if n.Bandwidth > 0 {
+		pace = time.Duration(size) * time.Second / time.Duration(n.Bandwidth)
+	}
+
+	return fail, trunc, cut, delay, pace, c.wdl
+}
+
+// send writes b to the connection below after delay, or right away if there's
+// neither a delay nor anything queued before it.
+func (c *netemConn) send(b []byte, delay time.Duration, last bool) error {
+	c.mu.Lock()
+	if c.err != nil {
+		defer c.mu.Unlock()
+		return c.err
+	}
+
+	if delay == 0 && c.idle == nil {
+		c.mu.Unlock()
+		_, err := c.Conn.Write(b)
+		if last {
+			c.Conn.Close()
+		}
+		return err
+	}
+	defer c.mu.Unlock()
+
+	// a later write can't overtake an earlier one
+	due := time.Now().Add(delay)
+	if due.Before(c.due) {
+		due = c.due
+	}
+	c.due = due
+
+	c.queue = append(c.queue, netemWrite{append([]byte(nil), b...), due, last})
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+		go c.deliver()
+	}
+	return nil
+}
+
+// deliver writes the queue to the connection below, each write on time.
+func (c *netemConn) deliver() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.queue) > 0 {
+		w := c.queue[0]
+		c.queue = c.queue[1:]
+
+		c.mu.Unlock()
+		time.Sleep(time.Until(w.due))
+		_, err := c.Conn.Write(w.b)
+		if w.close {
+			c.Conn.Close()
+		}
+		c.mu.Lock()
+
+		if err != nil {
+			// the rest wouldn't make it either
+			c.err = err
+			c.queue = nil
+		}
+	}
+
+	close(c.idle)
+	c.idle = nil
+}
+
+// drain waits until the queued writes are delivered, but no longer than
+// netemGrace past the last one's delivery time.
+func (c *netemConn) drain() {
+	c.mu.Lock()
+	idle, due := c.idle, c.due
+	c.mu.Unlock()
+
+	if idle == nil {
+		return
+	}
+
+	t := time.NewTimer(time.Until(due) + netemGrace)
+	defer t.Stop()
+	select {
+	case <-idle:
+	case <-t.C:
+	}
+}
+
+// sleepUntil sleeps until t, or fails once deadline passes, if it's set.
+func sleepUntil(t, deadline time.Time) error {
+	if !deadline.IsZero() && deadline.Before(t) {
+		time.Sleep(time.Until(deadline))
+		return os.ErrDeadlineExceeded
+	}
+	time.Sleep(time.Until(t))
+	return nil
+}
+
+func (c *netemConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdl = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *netemConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdl = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *netemConn) Close() error {
+	c.drain()
+	return c.Conn.Close()
+}
+
+func (c *netemConn) CloseRead() error {
+	if hc, ok := c.Conn.(interface {
+		CloseRead() error
+	}); ok {
+		return hc.CloseRead()
+	}
+	return match.ErrHalfClose
+}
+
+// CloseWrite waits for the queued writes first, so that the peer gets them
+// before EOF.
+func (c *netemConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		c.drain()
+		return hc.CloseWrite()
+	}
+	return match.ErrHalfClose
+}
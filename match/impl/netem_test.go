@@ -0,0 +1,208 @@
+package impl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+)
+
+func TestNetemDelay(t *testing.T) {
+	cases := []struct {
+		name  string
+		netem Netem
+		size  int
+		min   time.Duration
+	}{
+		{"latency", Netem{Latency: 20 * time.Millisecond}, 10, 20 * time.Millisecond},
+		{"jitter", Netem{Latency: 10 * time.Millisecond, Jitter: 10 * time.Millisecond}, 10, 10 * time.Millisecond},
+		{"bandwidth", Netem{Bandwidth: 100 << 10}, 5 << 10, 50 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		c1, c2 := memPipe(MemoryAddr("a"), MemoryAddr("b"))
+		nc := c.netem.Wrap(c1)
+
+		start := time.Now()
+		go nc.Write(make([]byte, c.size))
+		if _, err := io.ReadFull(c2, make([]byte, c.size)); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < c.min {
+			t.Errorf("%s: expected a delay of at least %s, got %s", c.name, c.min, d)
+		}
+
+		nc.Close()
+		c2.Close()
+	}
+}
+
+func TestNetemLatency(t *testing.T) {
+	c1, c2 := memPipe(MemoryAddr("a"), MemoryAddr("b"))
+	defer c2.Close()
+	nc := Netem{Latency: 50 * time.Millisecond, Jitter: 50 * time.Millisecond}.Wrap(c1)
+
+	// latency delays delivery, not the writer
+	start := time.Now()
+	for _, b := range []string{"a", "b", "c", "d"} {
+		if _, err := nc.Write([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 40*time.Millisecond {
+		t.Errorf("expected writes not to block, took %s", d)
+	}
+
+	// Close waits for the data in flight, which keeps its order
+	go nc.Close()
+	b, err := io.ReadAll(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "abcd" {
+		t.Errorf("expected \"abcd\", got %q", b)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected a delay of at least 50ms, got %s", d)
+	}
+}
+
+func TestNetemHalfClose(t *testing.T) {
+	c1, c2 := memPipe(MemoryAddr("a"), MemoryAddr("b"))
+	defer c2.Close()
+	nc := Netem{Latency: 20 * time.Millisecond}.Wrap(c1).(*netemConn)
+	defer nc.Close()
+
+	// EOF comes after the data in flight
+	nc.Write([]byte("hello"))
+	if err := nc.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(c2); err != nil || string(b) != "hello" {
+		t.Errorf("expected \"hello\" and EOF, got %q, %v", b, err)
+	}
+
+	// no half-close below
+	hc := Netem{}.Wrap(struct{ net.Conn }{c2}).(*netemConn)
+	if err := hc.CloseWrite(); !errors.Is(err, match.ErrHalfClose) {
+		t.Errorf("expected ErrHalfClose, got %v", err)
+	}
+	if err := hc.CloseRead(); !errors.Is(err, match.ErrHalfClose) {
+		t.Errorf("expected ErrHalfClose, got %v", err)
+	}
+}
+
+func TestNetemDeadline(t *testing.T) {
+	c1, c2 := memPipe(MemoryAddr("a"), MemoryAddr("b"))
+	defer c2.Close()
+	nc := Netem{Bandwidth: 10}.Wrap(c1)
+	defer nc.Close()
+
+	nc.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := nc.Write([]byte("x")); !isTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestNetemSeed(t *testing.T) {
+	netem := Netem{WriteFailure: 0.3, Truncate: 0.05, Seed: 42}
+
+	// the same seed leads to the same outcomes
+	wrap := func() (net.Conn, net.Conn) {
+		c1, c2 := memPipe(MemoryAddr("a"), MemoryAddr("b"))
+		return netem.Wrap(c1), c2
+	}
+	run := func(newConn func() (net.Conn, net.Conn)) []string {
+		nc, peer := newConn()
+		defer peer.Close()
+		go io.Copy(io.Discard, peer)
+		defer nc.Close()
+
+		outcomes := []string{}
+		for i := 0; i < 50; i++ {
+			n, err := nc.Write(make([]byte, 100))
+			switch err {
+			case nil:
+				outcomes = append(outcomes, "ok")
+			case ErrNetemWrite:
+				outcomes = append(outcomes, "fail")
+			case ErrNetemTruncated:
+				outcomes = append(outcomes, "truncated")
+				if n > 100 {
+					t.Errorf("truncated write of %d bytes", n)
+				}
+				return outcomes
+			default:
+				t.Fatal(err)
+			}
+		}
+		return outcomes
+	}
+
+	first := run(wrap)
+	second := run(wrap)
+	if len(first) != len(second) {
+		t.Fatalf("expected the same outcomes, got %v and %v", first, second)
+	}
+	fails := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected the same outcomes, got %v and %v", first, second)
+		}
+		if first[i] == "fail" {
+			fails++
+		}
+	}
+	if fails == 0 {
+		t.Errorf("expected some injected failures, got %v", first)
+	}
+
+	// accepted conns get their own sequences, which are replayed in the
+	// order a listener accepts them
+	accepted := func() []string {
+		netln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer netln.Close()
+		ln := &netemListener{Listener: netln, netem: netem}
+
+		var outcomes []string
+		for i := 0; i < 2; i++ {
+			outcomes = append(outcomes, fmt.Sprint(run(func() (net.Conn, net.Conn) {
+				c, err := net.Dial("tcp", netln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				sc, err := ln.Accept()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return sc, c
+			})))
+		}
+		return outcomes
+	}
+	a1, a2 := accepted(), accepted()
+	if fmt.Sprint(a1) != fmt.Sprint(a2) {
+		t.Errorf("expected listeners to replay the same outcomes, got %v and %v", a1, a2)
+	}
+	if a1[0] == a1[1] || a1[0] == fmt.Sprint(first) {
+		t.Errorf("expected every accepted conn to get other outcomes, got %v after %v", a1, first)
+	}
+
+	// a truncated conn is closed
+	c1, c2 := memPipe(MemoryAddr("a"), MemoryAddr("b"))
+	defer c2.Close()
+	nc := Netem{Truncate: 1}.Wrap(c1)
+	if _, err := nc.Write([]byte("hello")); err != ErrNetemTruncated {
+		t.Fatalf("expected a truncation, got %v", err)
+	}
+	if _, err := io.Copy(io.Discard, c2); err != nil {
+		t.Errorf("expected EOF after a truncation, got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package impl
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+const (
+	// DefaultTorSocksAddr is where Tor listens for SOCKS connections by
+	// default.
+	DefaultTorSocksAddr = "127.0.0.1:9050"
+
+	// DefaultOnionTimeout bounds dialing Tor and the SOCKS handshake, which
+	// lasts until Tor has built a circuit to the hidden service.
+	DefaultOnionTimeout = 2 * time.Minute
+)
+
+// OnionSupported reports whether the vendored go-multiaddr can decode /onion
+// addresses. Without patches/go-multiaddr-onion.patch it gets their size wrong
+// and panics printing them, so Onion isn't registered by default then.
+func OnionSupported() bool { return onionSupported }
+
+var onionSupported = onionRoundTrips()
+
+func onionRoundTrips() (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	const s = "/onion/timaq4ygg2iegci7:80/tcp/80"
+	m, err := ma.NewMultiaddr(s)
+	return err == nil && len(ma.Split(m)) == 2 && m.String() == s
+}
+
+// Onion dials Tor hidden services through the SOCKS port of a running Tor,
+// e.g. /onion/timaq4ygg2iegci7:80/http/ws/foo. The onion host goes to Tor as a
+// name, so it's never resolved locally. It only dials.
+type Onion struct {
+	// SocksAddr is the host:port of Tor's SOCKS port. Empty means
+	// DefaultTorSocksAddr.
+	SocksAddr string
+
+	// Socks configures the SOCKS5 handshake with Tor, e.g. a Username and
+	// Password to isolate streams. A zero Socks.Timeout means
+	// DefaultOnionTimeout.
+	Socks Socks5
+
+	// Timeout of dialing the SOCKS port. Zero means DefaultOnionTimeout.
+	Timeout time.Duration
+}
+
+func (_ Onion) Match(m ma.Multiaddr, side int) (int, bool) {
+	if side != match.S_Client {
+		return 0, false
+	}
+
+	if ps := m.Protocols(); len(ps) > 0 && ps[0].Name == "onion" {
+		return 1, true
+	}
+
+	return 0, false
+}
+
+func (_ Onion) Protocols(side int) []string {
+	if side != match.S_Client {
+		return nil
+	}
+	return []string{"onion"}
+}
+
+func (o Onion) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
+	if side != match.S_Client {
+		return fmt.Errorf("onion can only dial")
+	}
+
+	host, port, err := onionTarget(m)
+	if err != nil {
+		return err
+	}
+
+	sctx := ctx.Special()
+	if err := gateTarget(sctx, host); err != nil {
+		return err
+	}
+
+	// the connection to Tor is a TCP one, so it takes the TCP settings
+	var t TCP
+	if o, ok := TCPOptionsKey.Get(ctx); ok {
+		t.Options = o
+	}
+	if d, ok := TCPDialKey.Get(ctx); ok {
+		t.LocalAddr, t.ReusePort = d.LocalAddr, d.ReusePort
+	}
+
+	con, err := o.dial(t, host, port)
+	if err != nil {
+		return err
+	}
+
+	sctx.NetConn = con
+	sctx.PushClose(con.Close)
+
+	mctx := ctx.Misc()
+	mctx.Host = host
+	mctx.IPs = nil
+	return nil
+}
+
+// Dial connects to host (e.g. timaq4ygg2iegci7.onion) and port through Tor.
+func (o Onion) Dial(host string, port int) (net.Conn, error) {
+	return o.dial(TCP{}, host, port)
+}
+
+// dial is Dial with the LocalAddr, ReusePort and Options of t.
+func (o Onion) dial(t TCP, host string, port int) (net.Conn, error) {
+	addr := o.SocksAddr
+	if addr == "" {
+		addr = DefaultTorSocksAddr
+	}
+
+	d := t.dialer()
+	d.Timeout = o.Timeout
+	if d.Timeout == 0 {
+		d.Timeout = DefaultOnionTimeout
+	}
+
+	con, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial tor socks port: %s", err)
+	}
+
+	if err := t.Options.apply(con.(*net.TCPConn)); err != nil {
+		con.Close()
+		return nil, err
+	}
+
+	if o.Socks.Timeout == 0 {
+		o.Socks.Timeout = DefaultOnionTimeout
+	}
+	if err := o.Socks.Connect(con, host, port); err != nil {
+		con.Close()
+		return nil, err
+	}
+	return con, nil
+}
+
+// onionTarget returns the host name with the .onion suffix and the port of the
+// first /onion in m. It decodes the bytes itself, since go-multiaddr can't print
+// /onion values without patches/go-multiaddr-onion.patch.
+func onionTarget(m ma.Multiaddr) (string, int, error) {
+	b := m.Bytes()
+	code, n := ma.ReadVarintCode(b)
+	if code != ma.P_ONION || len(b) < n+12 {
+		return "", 0, fmt.Errorf("not an onion address")
+	}
+	b = b[n : n+12]
+
+	host := strings.ToLower(base32.StdEncoding.EncodeToString(b[:10]))
+	return host + ".onion", int(binary.BigEndian.Uint16(b[10:])), nil
+}
@@ -0,0 +1,124 @@
+package impl
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+func TestOnion(t *testing.T) {
+	if !OnionSupported() {
+		t.Skip("go-multiaddr can't decode /onion, see patches/go-multiaddr-onion.patch")
+	}
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	port, _ := strconv.Atoi(portOf(echo.Addr()))
+
+	tor := newSocksServer(t, "", "", map[string]string{"timaq4ygg2iegci7.onion": "127.0.0.1"})
+	defer tor.ln.Close()
+
+	m, err := ma.NewMultiaddr("/onion/timaq4ygg2iegci7:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := Onion{SocksAddr: tor.ln.Addr().String()}
+	if n, ok := o.Match(m, match.S_Client); !ok || n != 1 {
+		t.Fatalf("Match(%s) = %d, %v", m, n, ok)
+	}
+
+	ctx := &testContext{values: map[interface{}]interface{}{}}
+	if err := o.Apply(m, match.S_Client, ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.special.Close()
+
+	// the onion host went to tor unresolved
+	if got, expected := <-tor.requests, net.JoinHostPort("timaq4ygg2iegci7.onion", strconv.Itoa(port)); got != expected {
+		t.Errorf("tor was asked for %s, expected %s", got, expected)
+	}
+	if ctx.misc.Host != "timaq4ygg2iegci7.onion" || ctx.misc.IPs != nil {
+		t.Errorf("expected Host timaq4ygg2iegci7.onion and no IPs, got %q, %v", ctx.misc.Host, ctx.misc.IPs)
+	}
+
+	c := ctx.special.NetConn
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected ping echoed, got %q, %v", buf, err)
+	}
+
+	// nothing listens on the tor port
+	tor.ln.Close()
+	if err := o.Apply(m, match.S_Client, &testContext{}); err == nil {
+		t.Error("expected an error without tor")
+	}
+}
+
+func TestOnionDialOptions(t *testing.T) {
+	if !OnionSupported() {
+		t.Skip("go-multiaddr can't decode /onion, see patches/go-multiaddr-onion.patch")
+	}
+
+	// a tor that accepts, but never answers
+	tor, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tor.Close()
+	peers := make(chan net.Addr, 1)
+	go func() {
+		c, err := tor.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		peers <- c.RemoteAddr()
+		io.Copy(io.Discard, c)
+	}()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := free.Addr().(*net.TCPAddr)
+	free.Close()
+
+	m, err := ma.NewMultiaddr("/onion/timaq4ygg2iegci7:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &testContext{values: map[interface{}]interface{}{}}
+	TCPDialKey.Set(ctx, TCPDial{LocalAddr: laddr})
+
+	o := Onion{SocksAddr: tor.Addr().String(), Socks: Socks5{Timeout: 100 * time.Millisecond}}
+	start := time.Now()
+	if err := o.Apply(m, match.S_Client, ctx); err == nil {
+		t.Fatal("expected the handshake to time out")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("handshake gave up after %s", d)
+	}
+
+	if got := (<-peers).(*net.TCPAddr); got.Port != laddr.Port {
+		t.Errorf("tor was dialed from %s, expected %s", got, laddr)
+	}
+}
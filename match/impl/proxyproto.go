@@ -0,0 +1,483 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+func init() {
+	// a code from the private use range, like /socks5
+	ma.AddProtocol(ma.Protocol{Code: 0x300003, Size: 0, Name: "proxyproto", VCode: ma.CodeToVarint(0x300003)})
+}
+
+// ProxyProtoPolicy tells what a /proxyproto listener does with connections
+// without a PROXY protocol header, or from peers outside
+// ProxyProto.TrustedProxies. Invalid headers are always rejected.
+type ProxyProtoPolicy int
+
+const (
+	// ProxyProtoRequire rejects connections without a header and
+	// connections from untrusted peers.
+	ProxyProtoRequire ProxyProtoPolicy = iota
+
+	// ProxyProtoOptional accepts connections without a header as they are,
+	// and ignores the headers of untrusted peers. Clients must speak first,
+	// since the listener waits for their first bytes to tell.
+	ProxyProtoOptional
+)
+
+const (
+	// DefaultProxyProtoTimeout is how long a /proxyproto listener waits for
+	// a header, if ProxyProto.Timeout is zero.
+	DefaultProxyProtoTimeout = 10 * time.Second
+
+	// DefaultProxyProtoHandshakes is how many headers a /proxyproto
+	// listener reads at once, if ProxyProto.MaxHandshakes is zero.
+	DefaultProxyProtoHandshakes = 64
+)
+
+// ErrProxyProtoHeader is what a /proxyproto listener rejects connections
+// with, if they lack a valid header or, under ProxyProtoRequire, come from
+// untrusted peers. Rejected connections are closed rather than returned by
+// Accept.
+var ErrProxyProtoHeader = errors.New("proxyproto: missing or invalid header")
+
+// ProxyProto reads HAProxy PROXY protocol (v1 and v2) headers, which load
+// balancers put in front of connections they forward, e.g.
+// /ip4/0.0.0.0/tcp/80/proxyproto/http/ws/foo. The RemoteAddr of accepted
+// connections is then the original client's, and PeerAddr is the balancer's.
+// Rejected connections are closed without being returned by Accept.
+//
+// Dialing sends a v2 header with the addresses of the connection below, as a
+// balancer would, or one without addresses if they aren't TCP.
+type ProxyProto struct {
+	Policy ProxyProtoPolicy
+
+	// TrustedProxies are networks of balancers, whose headers are honoured.
+	// Anyone else could claim any client address with one, so what happens
+	// to their connections depends on Policy. Empty trusts no one.
+	TrustedProxies []*net.IPNet
+
+	// Timeout of reading a header. Zero means DefaultProxyProtoTimeout.
+	Timeout time.Duration
+
+	// MaxHandshakes limits how many headers are read at once. Once
+	// reached, accepting waits for a header to be read, or for Accept to
+	// take a connection, which was. Zero means DefaultProxyProtoHandshakes.
+	MaxHandshakes int
+}
+
+func (_ ProxyProto) Match(m ma.Multiaddr, side int) (int, bool) {
+	ps := m.Protocols()
+
+	if len(ps) > 0 && ps[0].Name == "proxyproto" {
+		return 1, true
+	}
+
+	return 0, false
+}
+
+func (_ ProxyProto) Protocols(side int) []string {
+	return []string{"proxyproto"}
+}
+
+func (p ProxyProto) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
+	sctx := ctx.Special()
+
+	switch side {
+
+	case match.S_Client:
+		if sctx.NetConn == nil {
+			return fmt.Errorf("no connection to send a proxy header on")
+		}
+		c := sctx.NetConn
+		if _, err := c.Write(proxyHeader(c.LocalAddr(), c.RemoteAddr())); err != nil {
+			return err
+		}
+		return nil
+
+	case match.S_Server:
+		if sctx.NetListener == nil {
+			return fmt.Errorf("no listener to read proxy headers on")
+		}
+		pl := p.wrap(sctx.NetListener)
+		sctx.NetListener = pl
+		sctx.PushClose(pl.stop)
+		return nil
+
+	}
+
+	return fmt.Errorf("incorrect side constant")
+}
+
+// Wrap returns a listener, which reads headers of connections accepted by ln.
+// Closing it closes ln.
+func (p ProxyProto) Wrap(ln net.Listener) net.Listener {
+	return p.wrap(ln)
+}
+
+func (p ProxyProto) wrap(ln net.Listener) *proxyListener {
+	if p.Timeout <= 0 {
+		p.Timeout = DefaultProxyProtoTimeout
+	}
+	if p.MaxHandshakes <= 0 {
+		p.MaxHandshakes = DefaultProxyProtoHandshakes
+	}
+
+	pl := &proxyListener{
+		Listener: ln,
+		proxy:    p,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		slots:    make(chan struct{}, p.MaxHandshakes),
+		pending:  map[net.Conn]bool{},
+	}
+	go pl.serve()
+	return pl
+}
+
+// proxyListener reads headers in the background, so that a slow client
+// doesn't hold up Accept.
+type proxyListener struct {
+	net.Listener
+	proxy ProxyProto
+	conns chan net.Conn
+	done  chan struct{} // closed once serve returns, err is set by then
+	err   error
+
+	// a conn holds a slot from before it's accepted until Accept returns it
+	// or it's rejected, stopped is closed to stop waiting for one
+	slots    chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	mu      sync.Mutex
+	pending map[net.Conn]bool // conns, whose headers are being read
+}
+
+func (l *proxyListener) Close() error {
+	l.stop()
+	return l.Listener.Close()
+}
+
+// stop makes serve return, even if it's waiting for a slot rather than for
+// ln, which is closed separately.
+func (l *proxyListener) stop() error {
+	l.stopOnce.Do(func() { close(l.stopped) })
+	return nil
+}
+
+func (l *proxyListener) serve() {
+	defer func() {
+		l.mu.Lock()
+		for c := range l.pending {
+			c.Close()
+		}
+		l.pending = nil
+		l.mu.Unlock()
+		close(l.done)
+	}()
+
+	for {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.stopped:
+			l.err = net.ErrClosed
+			return
+		}
+
+		c, err := l.Listener.Accept()
+		if err != nil {
+			<-l.slots
+			if ne, ok := err.(interface {
+				Temporary() bool
+			}); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			return
+		}
+
+		l.mu.Lock()
+		if l.pending == nil {
+			l.mu.Unlock()
+			<-l.slots
+			c.Close()
+			return
+		}
+		l.pending[c] = true
+		l.mu.Unlock()
+
+		go l.handshake(c)
+	}
+}
+
+func (l *proxyListener) handshake(c net.Conn) {
+	defer func() { <-l.slots }()
+
+	pc, err := l.proxy.readHeader(c)
+
+	l.mu.Lock()
+	stopped := l.pending == nil
+	delete(l.pending, c)
+	l.mu.Unlock()
+
+	if err != nil || stopped {
+		c.Close()
+		return
+	}
+
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// proxyConn is an accepted connection, which reports the client address
+// from its header.
+type proxyConn struct {
+	net.Conn          // reads what's buffered after the header first
+	raw      net.Conn // as accepted
+	raddr    net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.raddr }
+
+// PeerAddr returns the address of the balancer, which sent the header.
+func (c *proxyConn) PeerAddr() net.Addr { return c.raw.RemoteAddr() }
+
+func (c *proxyConn) CloseRead() error {
+	if hc, ok := c.raw.(interface {
+		CloseRead() error
+	}); ok {
+		return hc.CloseRead()
+	}
+	return match.ErrHalfClose
+}
+
+func (c *proxyConn) CloseWrite() error {
+	if hc, ok := c.raw.(interface {
+		CloseWrite() error
+	}); ok {
+		return hc.CloseWrite()
+	}
+	return match.ErrHalfClose
+}
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readHeader reads a header from c and returns c with its remote address set
+// to what the header says, if c comes from a trusted peer.
+func (p ProxyProto) readHeader(c net.Conn) (net.Conn, error) {
+	trusted := p.trusts(c.RemoteAddr())
+	if !trusted && p.Policy != ProxyProtoOptional {
+		return nil, ErrProxyProtoHeader
+	}
+
+	c.SetReadDeadline(time.Now().Add(p.Timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(c, 256)
+	raddr := c.RemoteAddr()
+
+	v1, err := peekPrefix(br, []byte("PROXY "))
+	if err != nil {
+		return nil, err
+	}
+	v2 := false
+	if !v1 {
+		if v2, err = peekPrefix(br, proxyV2Sig); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case v1:
+		addr, err := readProxyV1(br)
+		if err != nil {
+			return nil, err
+		}
+		if addr != nil && trusted {
+			raddr = addr
+		}
+	case v2:
+		addr, err := readProxyV2(br)
+		if err != nil {
+			return nil, err
+		}
+		if addr != nil && trusted {
+			raddr = addr
+		}
+	case p.Policy != ProxyProtoOptional:
+		return nil, ErrProxyProtoHeader
+	}
+
+	var con net.Conn = c
+	if br.Buffered() > 0 {
+		con = newBufferedConn(c, br)
+	}
+	return &proxyConn{con, c, raddr}, nil
+}
+
+// trusts reports whether headers from a peer at addr are honoured.
+func (p ProxyProto) trusts(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	return ok && ipInNets(ta.IP, p.TrustedProxies)
+}
+
+// peekPrefix reports whether br starts with prefix, peeking no further than
+// the first byte, which differs.
+func peekPrefix(br *bufio.Reader, prefix []byte) (bool, error) {
+	for i := 1; i <= len(prefix); i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+		if b[i-1] != prefix[i-1] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// readProxyV1 reads a text header, e.g. "PROXY TCP4 1.2.3.4 5.6.7.8 80 443\r\n",
+// and returns its source address, or nil for "PROXY UNKNOWN".
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // the maximum length of a v1 header
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyProtoHeader
+	}
+
+	f := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, ErrProxyProtoHeader
+	}
+
+	ip := net.ParseIP(f[2])
+	if ip == nil || (ip.To4() != nil) != (f[1] == "TCP4") || net.ParseIP(f[3]) == nil {
+		return nil, ErrProxyProtoHeader
+	}
+	port, err := strconv.Atoi(f[4])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, ErrProxyProtoHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads a binary header and returns its source address, or nil
+// if it has none, e.g. for a LOCAL command, like health checks send, or one
+// of an address family other than TCP over IP.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+
+	verCmd, famProto := hdr[12], hdr[13]
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, ErrProxyProtoHeader
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, ErrProxyProtoHeader
+	}
+
+	switch famProto {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, ErrProxyProtoHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[0:4]...)),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, ErrProxyProtoHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	// unspecified, or e.g. UDP or a unix socket, which the spec says to
+	// fall back to the real address for
+	return nil, nil
+}
+
+// proxyHeader returns a v2 header of a connection from src to dst.
+func proxyHeader(src, dst net.Addr) []byte {
+	h := append([]byte(nil), proxyV2Sig...)
+
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+		return append(h, 0x20, 0x00, 0, 0) // LOCAL, no addresses
+	}
+
+	var addrs []byte
+	if s.IP.To4() != nil {
+		h = append(h, 0x21, 0x11)
+		addrs = append(append(addrs, s.IP.To4()...), d.IP.To4()...)
+	} else {
+		h = append(h, 0x21, 0x21)
+		addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(s.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(d.Port))
+	addrs = append(addrs, ports...)
+
+	size := make([]byte, 2)
+	binary.BigEndian.PutUint16(size, uint16(len(addrs)))
+	h = append(h, size...)
+	return append(h, addrs...)
+}
@@ -0,0 +1,228 @@
+package impl
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+)
+
+func TestProxyProto(t *testing.T) {
+	netln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	ln := ProxyProto{Timeout: time.Second, TrustedProxies: []*net.IPNet{loopback}}.Wrap(netln)
+	defer ln.Close()
+	addr := netln.Addr().String()
+
+	send := func(header string) net.Conn {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte(header + "hello"))
+		return c
+	}
+
+	// a client, which never sends a header, doesn't hold up the others
+	slow, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	v2 := proxyHeader(
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+	)
+	local := proxyHeader(MemoryAddr("a"), MemoryAddr("b"))
+	// PROXY commands of UDP over IPv4 and of a unix stream socket
+	udp := string(proxyV2Sig) + "\x21\x12\x00\x0c" + strings.Repeat("\x01", 12)
+	unix := string(proxyV2Sig) + "\x21\x31\x00\xd8" + strings.Repeat("\x00", 216)
+
+	cases := []struct {
+		header string
+		raddr  string // empty for the real one
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 5678 80\r\n", "192.0.2.1:5678"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{string(v2), "[2001:db8::1]:1234"},
+		{string(local), ""},
+		{udp, ""},
+		{unix, ""},
+	}
+
+	for _, cs := range cases {
+		c := send(cs.header)
+		defer c.Close()
+
+		sc, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sc.Close()
+
+		expected := cs.raddr
+		if expected == "" {
+			expected = c.LocalAddr().String()
+		}
+		if got := sc.RemoteAddr().String(); got != expected {
+			t.Errorf("%q: expected RemoteAddr %s, got %s", cs.header, expected, got)
+		}
+		if got := sc.(*proxyConn).PeerAddr().String(); got != c.LocalAddr().String() {
+			t.Errorf("%q: expected PeerAddr %s, got %s", cs.header, c.LocalAddr(), got)
+		}
+
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("%q: expected hello after the header, got %q, %v", cs.header, buf, err)
+		}
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	pc := &proxyConn{a, a, a.RemoteAddr()}
+	if err := pc.CloseWrite(); err != match.ErrHalfClose {
+		t.Errorf("expected ErrHalfClose from CloseWrite, got %v", err)
+	}
+
+	// rejected conns are closed and never accepted
+	for _, header := range []string{
+		"",
+		"PROXY TCP4 192.0.2.1\r\n",
+		"PROXY TCP6 192.0.2.1 192.0.2.2 5678 80\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x22\x11\x00\x00",
+	} {
+		c := send(header)
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+			t.Errorf("%q: expected the conn closed, got %v", header, err)
+		}
+	}
+}
+
+func TestProxyProtoOptional(t *testing.T) {
+	netln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := ProxyProto{Policy: ProxyProtoOptional}.Wrap(netln)
+	defer ln.Close()
+
+	c, err := net.Dial("tcp", netln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROBE")) // looks like a header at first
+
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	if got := sc.RemoteAddr().String(); got != c.LocalAddr().String() {
+		t.Errorf("expected RemoteAddr %s, got %s", c.LocalAddr(), got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "PROBE" {
+		t.Errorf("expected PROBE, got %q, %v", buf, err)
+	}
+}
+
+func TestProxyProtoUntrusted(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+
+	for _, policy := range []ProxyProtoPolicy{ProxyProtoRequire, ProxyProtoOptional} {
+		netln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := ProxyProto{Policy: policy, TrustedProxies: []*net.IPNet{trusted}}.Wrap(netln)
+		defer ln.Close()
+
+		c, err := net.Dial("tcp", netln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5678 80\r\nhello"))
+
+		if policy == ProxyProtoRequire {
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := c.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+				t.Errorf("expected the untrusted conn closed, got %v", err)
+			}
+			continue
+		}
+
+		// the header is read, but the client address in it isn't believed
+		sc, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sc.Close()
+		if got := sc.RemoteAddr().String(); got != c.LocalAddr().String() {
+			t.Errorf("expected RemoteAddr %s, got %s", c.LocalAddr(), got)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("expected hello after the header, got %q, %v", buf, err)
+		}
+	}
+}
+
+func TestProxyProtoMaxHandshakes(t *testing.T) {
+	netln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	timeout := 200 * time.Millisecond
+	ln := ProxyProto{Timeout: timeout, MaxHandshakes: 1, TrustedProxies: []*net.IPNet{loopback}}.Wrap(netln)
+	addr := netln.Addr().String()
+
+	// a client, which never sends a header, takes the only slot
+	slow, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Close()
+	if d := time.Since(start); d < timeout/2 {
+		t.Errorf("accepted after %s, before the slow client timed out", d)
+	}
+
+	// Close stops it, while it waits for a slot
+	slow2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow2.Close()
+	time.Sleep(50 * time.Millisecond)
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Error("expected Accept to fail after Close")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !mips && !mipsle && !mips64 && !mips64le)
+
+package impl
+
+import "syscall"
+
+// reusePort is a net.Dialer and net.ListenConfig Control function setting
+// SO_REUSEADDR and SO_REUSEPORT on a socket.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if err == nil {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
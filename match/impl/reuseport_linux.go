@@ -0,0 +1,6 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le
+
+package impl
+
+// missing from package syscall on some architectures
+const soReusePort = 0xf
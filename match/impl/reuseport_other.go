@@ -0,0 +1,13 @@
+//go:build !(darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !mips && !mipsle && !mips64 && !mips64le))
+
+package impl
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
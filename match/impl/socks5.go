@@ -0,0 +1,268 @@
+package impl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+func init() {
+	// a code from the private use range, until socks5 gets an official one
+	ma.AddProtocol(ma.Protocol{Code: 0x300001, Size: 0, Name: "socks5", VCode: ma.CodeToVarint(0x300001)})
+}
+
+// Socks5 tunnels through a SOCKS5 proxy (RFC 1928) to the address following
+// /socks5, e.g. /dns/proxy/tcp/1080/socks5/dns/example.com/tcp/443/ws. The
+// proxy is whatever the chain before /socks5 connects to. It only dials.
+//
+// A /dns target is resolved by the proxy, so the local resolver never sees it.
+type Socks5 struct {
+	// Username and Password authenticate with the proxy (RFC 1929), if
+	// Username is set. Otherwise no authentication is offered.
+	Username string
+	Password string
+
+	// Timeout of the handshake with the proxy. Zero means none.
+	Timeout time.Duration
+}
+
+func (_ Socks5) Match(m ma.Multiaddr, side int) (int, bool) {
+	if side != match.S_Client {
+		return 0, false
+	}
+
+	if ps := m.Protocols(); len(ps) >= 3 && ps[0].Name == "socks5" && isProxyTarget(ps[1:3]) {
+		return 3, true
+	}
+
+	return 0, false
+}
+
+func (_ Socks5) Protocols(side int) []string {
+	if side != match.S_Client {
+		return nil
+	}
+	return []string{"socks5"}
+}
+
+func (s Socks5) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
+	if side != match.S_Client {
+		return fmt.Errorf("socks5 can only dial")
+	}
+
+	host, port, err := proxyTarget(m)
+	if err != nil {
+		return err
+	}
+
+	sctx := ctx.Special()
+	if sctx.NetConn == nil {
+		return fmt.Errorf("no connection to a socks5 proxy")
+	}
+
+	if err := gateTarget(sctx, host); err != nil {
+		return err
+	}
+	if err := s.Connect(sctx.NetConn, host, port); err != nil {
+		return err
+	}
+
+	setProxyTarget(ctx.Misc(), host)
+	return nil
+}
+
+// Connect asks the SOCKS5 proxy at the other end of c to connect to host and
+// port. On success, c carries the tunnelled connection.
+func (s Socks5) Connect(c net.Conn, host string, port int) (err error) {
+	if s.Timeout > 0 {
+		c.SetDeadline(time.Now().Add(s.Timeout))
+		defer c.SetDeadline(time.Time{})
+	}
+
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("socks5 %s: %s", net.JoinHostPort(host, strconv.Itoa(port)), err)
+		}
+	}()
+
+	if err := s.authenticate(c); err != nil {
+		return err
+	}
+
+	req := []byte{5, 1, 0} // version, CONNECT, reserved
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		req = append(req, 1)
+		req = append(req, ip.To4()...)
+	case ip != nil:
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return fmt.Errorf("host name is too long")
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	}
+	portb := make([]byte, 2)
+	binary.BigEndian.PutUint16(portb, uint16(port))
+	req = append(req, portb...)
+
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	// version, reply, reserved, address type
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return err
+	}
+	if resp[0] != 5 {
+		return fmt.Errorf("unexpected version %d", resp[0])
+	}
+	if resp[1] != 0 {
+		return fmt.Errorf("%s", socks5Reply(resp[1]))
+	}
+
+	// skip the bound address and port
+	var n int
+	switch resp[3] {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", resp[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, n+2))
+	return err
+}
+
+// authenticate negotiates an authentication method and goes through it.
+func (s Socks5) authenticate(c net.Conn) error {
+	greeting := []byte{5, 1, 0} // version, one method: no authentication
+	if s.Username != "" {
+		greeting = []byte{5, 2, 0, 2} // or username/password
+	}
+	if _, err := c.Write(greeting); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return err
+	}
+	if resp[0] != 5 {
+		return fmt.Errorf("unexpected version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case 0:
+		return nil
+	case 2:
+		if s.Username == "" {
+			return fmt.Errorf("proxy picked an authentication method that wasn't offered")
+		}
+	default:
+		return fmt.Errorf("proxy requires an unsupported authentication method")
+	}
+
+	if len(s.Username) > 255 || len(s.Password) > 255 {
+		return fmt.Errorf("username or password is too long")
+	}
+	req := []byte{1, byte(len(s.Username))}
+	req = append(req, s.Username...)
+	req = append(req, byte(len(s.Password)))
+	req = append(req, s.Password...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return fmt.Errorf("authentication failed")
+	}
+	return nil
+}
+
+func socks5Reply(code byte) string {
+	switch code {
+	case 1:
+		return "general server failure"
+	case 2:
+		return "connection not allowed by ruleset"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("unknown reply %d", code)
+}
+
+// isProxyTarget reports whether ps is a target a proxy can connect to, i.e.
+// an ip4, ip6 or dns host followed by tcp.
+func isProxyTarget(ps []ma.Protocol) bool {
+	switch ps[0].Name {
+	case "ip4", "ip6", "dns":
+		return ps[1].Name == "tcp"
+	}
+	return false
+}
+
+// proxyTarget returns the host and port following a proxy protocol in m,
+// which was matched with isProxyTarget.
+func proxyTarget(m ma.Multiaddr) (string, int, error) {
+	ps := m.Protocols()
+	if len(ps) < 3 || !isProxyTarget(ps[1:3]) {
+		return "", 0, fmt.Errorf("no proxy target in %s", m)
+	}
+
+	host := protocolValue(m, ps[1])
+	port, err := strconv.Atoi(protocolValue(m, ps[2]))
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+// gateTarget asks sctx.GateTarget, if it's set, whether a proxy may connect
+// to host.
+func gateTarget(sctx *match.SpecialContext, host string) error {
+	if sctx.GateTarget == nil {
+		return nil
+	}
+	return sctx.GateTarget(host)
+}
+
+// setProxyTarget tells the rest of the chain, where the proxy connected to.
+// IPs of a host name are unknown, since the proxy resolved it.
+func setProxyTarget(mctx *match.MiscContext, host string) {
+	mctx.Host = host
+	mctx.IPs = nil
+	if ip := net.ParseIP(host); ip != nil {
+		mctx.IPs = []net.IP{ip}
+	}
+}
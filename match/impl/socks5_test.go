@@ -0,0 +1,191 @@
+package impl
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// socksServer is a minimal SOCKS5 proxy. It resolves host names through
+// hosts only, so a test can tell they weren't resolved by the client.
+type socksServer struct {
+	ln       net.Listener
+	username string
+	password string
+	hosts    map[string]string
+	requests chan string // "host:port" of every CONNECT
+}
+
+func newSocksServer(t *testing.T, username, password string, hosts map[string]string) *socksServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{ln, username, password, hosts, make(chan string, 10)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) serve(c net.Conn) {
+	defer c.Close()
+
+	buf := make([]byte, 256)
+	read := func(n int) []byte {
+		if _, err := io.ReadFull(c, buf[:n]); err != nil {
+			panic(err)
+		}
+		return buf[:n]
+	}
+	defer func() { recover() }()
+
+	methods := string(read(int(read(2)[1])))
+	if s.username == "" {
+		c.Write([]byte{5, 0})
+	} else if !strings.Contains(methods, "\x02") {
+		c.Write([]byte{5, 0xff})
+		return
+	} else {
+		c.Write([]byte{5, 2})
+		read(1)
+		user := string(read(int(read(1)[0])))
+		pass := string(read(int(read(1)[0])))
+		if user != s.username || pass != s.password {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+	}
+
+	var host string
+	switch read(4)[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 4:
+		host = net.IP(read(16)).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(read(2))))
+	s.requests <- net.JoinHostPort(host, port)
+
+	if addr, ok := s.hosts[host]; ok {
+		host = addr
+	} else if net.ParseIP(host) == nil {
+		c.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	go io.Copy(target, c)
+	io.Copy(c, target)
+}
+
+func TestSocks5(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	port := portOf(echo.Addr())
+
+	proxy := newSocksServer(t, "user", "secret", map[string]string{"echo.test": "127.0.0.1"})
+	defer proxy.ln.Close()
+
+	dial := func(s Socks5, target string) (*testContext, error) {
+		c, err := net.Dial("tcp", proxy.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := &testContext{values: map[interface{}]interface{}{}}
+		ctx.special.NetConn = c
+		ctx.special.PushClose(c.Close)
+
+		m, err := ma.NewMultiaddr("/socks5" + target + "/tcp/" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, ok := s.Match(m, match.S_Client); !ok || n != 3 {
+			t.Fatalf("Match(%s) = %d, %v", m, n, ok)
+		}
+		return ctx, s.Apply(m, match.S_Client, ctx)
+	}
+
+	// a host name goes to the proxy unresolved
+	ctx, err := dial(Socks5{Username: "user", Password: "secret"}, "/dns/echo.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-proxy.requests; got != "echo.test:"+port {
+		t.Errorf("proxy was asked for %s", got)
+	}
+	if ctx.misc.Host != "echo.test" || ctx.misc.IPs != nil {
+		t.Errorf("expected Host echo.test and no IPs, got %q, %v", ctx.misc.Host, ctx.misc.IPs)
+	}
+	c := ctx.special.NetConn
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected ping echoed, got %q, %v", buf, err)
+	}
+	ctx.special.Close()
+
+	// an IP target
+	ctx, err = dial(Socks5{Username: "user", Password: "secret"}, "/ip4/127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-proxy.requests
+	if len(ctx.misc.IPs) != 1 || !ctx.misc.IPs[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expected IPs [127.0.0.1], got %v", ctx.misc.IPs)
+	}
+	ctx.special.Close()
+
+	// failures
+	for _, c := range []struct {
+		s      Socks5
+		target string
+		err    string
+	}{
+		{Socks5{}, "/dns/echo.test", "unsupported authentication method"},
+		{Socks5{Username: "user", Password: "wrong"}, "/dns/echo.test", "authentication failed"},
+		{Socks5{Username: "user", Password: "secret"}, "/dns/nowhere.test", "host unreachable"},
+	} {
+		ctx, err := dial(c.s, c.target)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error with %q, got %v", c.target, c.err, err)
+		}
+		ctx.special.Close()
+	}
+}
@@ -1,16 +1,53 @@
 package impl
 
 import (
+	"context"
 	"fmt"
 	"github.com/Gaboose/go-multiaddr-net/match"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 
 	ma "github.com/jbenet/go-multiaddr"
 )
 
-type TCP struct{}
+type TCP struct {
+	// Limits of listeners. Excess connections are closed right after
+	// they're accepted. They apply to all TCP connections, including ones
+	// carrying /http.
+	Limits match.Limits
+
+	// LocalAddr, if set, is the local address of dialed connections, e.g.
+	// to pick a source interface on a multihomed host. A zero Port picks
+	// any free one. TCPDialKey overrides it for a single Dial.
+	LocalAddr *net.TCPAddr
+
+	// ReusePort sets SO_REUSEADDR and SO_REUSEPORT on dialing and listening
+	// sockets, so that a dial may use the port of an active listener as its
+	// LocalAddr, e.g. for NAT hole punching. Both sides need it set.
+	// TCPDialKey overrides it for a single Dial or Listen.
+	ReusePort bool
+
+	// Options of dialed and accepted connections. TCPOptionsKey overrides
+	// them for a single Dial or Listen.
+	Options TCPOptions
+}
+
+// TCPDial holds the settings of TCP, which depend on a single connection
+// rather than on the host, like the port to punch a hole from.
+type TCPDial struct {
+	LocalAddr *net.TCPAddr
+	ReusePort bool
+}
+
+// TCPDialKey overrides TCP.LocalAddr and TCP.ReusePort for a single Dial or
+// Listen, if set in the Context passed to them, e.g.
+//
+//	ctx := manet.NewContext()
+//	impl.TCPDialKey.Set(ctx, impl.TCPDial{LocalAddr: laddr, ReusePort: true})
+//	c, err := manet.DialWithContext(m, ctx)
+var TCPDialKey = match.NewKey[TCPDial]("impl/tcp.dial")
 
 func (t TCP) Match(m ma.Multiaddr, side int) (int, bool) {
 	ps := m.Protocols()
@@ -26,8 +63,15 @@ func (t TCP) Match(m ma.Multiaddr, side int) (int, bool) {
 	return 0, false
 }
 
+func (t TCP) Protocols(side int) []string {
+	return []string{"tcp"}
+}
+
 func (t TCP) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
-	p := m.Protocols()[0]
+	p, err := firstProtocol(m)
+	if err != nil {
+		return err
+	}
 	portstr, _ := m.ValueForProtocol(p.Code)
 
 	port, err := strconv.Atoi(portstr)
@@ -38,6 +82,13 @@ func (t TCP) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
 	mctx := ctx.Misc()
 	sctx := ctx.Special()
 
+	if o, ok := TCPOptionsKey.Get(ctx); ok {
+		t.Options = o
+	}
+	if d, ok := TCPDialKey.Get(ctx); ok {
+		t.LocalAddr, t.ReusePort = d.LocalAddr, d.ReusePort
+	}
+
 	if len(mctx.IPs) == 0 {
 		return fmt.Errorf("no ips in context")
 	}
@@ -57,7 +108,7 @@ func (t TCP) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
 		}
 
 		sctx.NetConn = con
-		sctx.CloseFn = con.Close
+		sctx.PushClose(con.Close)
 		return nil
 
 	case match.S_Server:
@@ -65,8 +116,8 @@ func (t TCP) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
 		if err != nil {
 			return err
 		}
-		sctx.NetListener = netln
-		sctx.CloseFn = netln.Close
+		sctx.NetListener = t.wrap(netln)
+		sctx.PushClose(netln.Close)
 		return nil
 
 	}
@@ -129,21 +180,105 @@ Loop: // count errors, but break out immidiately on first successful connection
 func (t TCP) Dial(ip net.IP, port int) (*net.TCPConn, error) {
 	addr := &net.TCPAddr{IP: ip, Port: port}
 
-	con, err := net.DialTCP("tcp", nil, addr)
+	d := t.dialer()
+	con, err := d.Dial("tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
 
-	return con, nil
+	tcpcon := con.(*net.TCPConn)
+	if err := t.Options.apply(tcpcon); err != nil {
+		tcpcon.Close()
+		return nil, err
+	}
+
+	return tcpcon, nil
+}
+
+// dialer returns a Dialer with the LocalAddr, ReusePort and KeepAlive of t.
+func (t TCP) dialer() net.Dialer {
+	d := net.Dialer{KeepAlive: t.Options.KeepAlive}
+	if t.LocalAddr != nil {
+		d.LocalAddr = t.LocalAddr
+	}
+	if t.ReusePort {
+		d.Control = reusePort
+	}
+	return d
 }
 
 func (t TCP) Listen(ip net.IP, port int) (*net.TCPListener, error) {
 	addr := &net.TCPAddr{IP: ip, Port: port}
 
-	ln, err := net.ListenTCP("tcp", addr)
+	lc := net.ListenConfig{KeepAlive: t.Options.KeepAlive}
+	if t.ReusePort {
+		lc.Control = reusePort
+	}
+
+	ln, err := lc.Listen(context.Background(), "tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
 
-	return ln, nil
+	return ln.(*net.TCPListener), nil
+}
+
+// wrap wraps ln to enforce t.Limits and set t.Options on accepted
+// connections, if there are any. KeepAlive is already set by Listen.
+func (t TCP) wrap(ln *net.TCPListener) net.Listener {
+	opts := t.Options
+	opts.KeepAlive = 0
+	if t.Limits == (match.Limits{}) && opts == (TCPOptions{}) {
+		return ln
+	}
+	return &tcpListener{TCPListener: ln, limits: t.Limits, opts: opts}
+}
+
+type tcpListener struct {
+	*net.TCPListener
+	limits match.Limits
+	opts   TCPOptions
+	conns  match.ConnCounter
+}
+
+func (l *tcpListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.limits == (match.Limits{}) {
+			if err := l.opts.apply(c); err != nil {
+				c.Close()
+				continue
+			}
+			return c, nil
+		}
+
+		ip := c.RemoteAddr().(*net.TCPAddr).IP.String()
+		if err := l.conns.Acquire(ip, l.limits.MaxConns, l.limits.MaxConnsPerIP); err != nil {
+			c.Close()
+			continue
+		}
+
+		lc := &limitConn{TCPConn: c, release: func() { l.conns.Release(ip) }}
+		if err := l.opts.apply(c); err != nil {
+			lc.Close()
+			continue
+		}
+		return lc, nil
+	}
+}
+
+// limitConn releases its place in a tcpListener once closed.
+type limitConn struct {
+	*net.TCPConn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.TCPConn.Close()
 }
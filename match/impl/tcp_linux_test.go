@@ -0,0 +1,121 @@
+package impl
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+var testTCPOptions = TCPOptions{
+	KeepAlive:      42 * time.Second,
+	DisableNoDelay: true,
+	Linger:         1500 * time.Millisecond,
+	ReadBuffer:     64 << 10,
+	WriteBuffer:    128 << 10,
+}
+
+func TestTCPOptions(t *testing.T) {
+	tcp := TCP{Options: testTCPOptions}
+	lo := net.ParseIP("127.0.0.1")
+
+	netln, err := tcp.Listen(lo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := tcp.wrap(netln)
+	defer ln.Close()
+	port := netln.Addr().(*net.TCPAddr).Port
+
+	c, err := tcp.Dial(lo, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assertTCPOptions(t, "Dial", c, testTCPOptions)
+
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertTCPOptions(t, "Accept", s.(*net.TCPConn), testTCPOptions)
+
+	c, err = tcp.DialMany([]net.IP{lo, lo}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assertTCPOptions(t, "DialMany", c, testTCPOptions)
+}
+
+func TestTCPOptionsKey(t *testing.T) {
+	netln, err := TCP{}.Listen(net.ParseIP("127.0.0.1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netln.Close()
+
+	m, err := ma.NewMultiaddr("/tcp/" + portOf(netln.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &testContext{values: map[interface{}]interface{}{}}
+	ctx.misc.IPs = []net.IP{net.ParseIP("127.0.0.1")}
+	TCPOptionsKey.Set(ctx, testTCPOptions)
+
+	if err := (TCP{}).Apply(m, match.S_Client, ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.special.Close()
+	assertTCPOptions(t, "Apply", ctx.special.NetConn.(*net.TCPConn), testTCPOptions)
+}
+
+func assertTCPOptions(t *testing.T, name string, c *net.TCPConn, o TCPOptions) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(level, opt int) int {
+		var v int
+		var err error
+		rc.Control(func(fd uintptr) {
+			v, err = syscall.GetsockoptInt(int(fd), level, opt)
+		})
+		if err != nil {
+			t.Fatalf("%s: getsockopt: %s", name, err)
+		}
+		return v
+	}
+
+	if get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 1 {
+		t.Errorf("%s: expected keep-alives on", name)
+	}
+	if v := get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != int(o.KeepAlive/time.Second) {
+		t.Errorf("%s: expected keep-alive period %s, got %ds", name, o.KeepAlive, v)
+	}
+	if get(syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Errorf("%s: expected TCP_NODELAY off", name)
+	}
+	// the first field of struct linger, l_onoff
+	if get(syscall.SOL_SOCKET, syscall.SO_LINGER) != 1 {
+		t.Errorf("%s: expected SO_LINGER on", name)
+	}
+	// linux doubles buffer sizes for bookkeeping
+	if v := get(syscall.SOL_SOCKET, syscall.SO_RCVBUF); v < o.ReadBuffer {
+		t.Errorf("%s: expected read buffer of at least %d, got %d", name, o.ReadBuffer, v)
+	}
+	if v := get(syscall.SOL_SOCKET, syscall.SO_SNDBUF); v < o.WriteBuffer {
+		t.Errorf("%s: expected write buffer of at least %d, got %d", name, o.WriteBuffer, v)
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
@@ -0,0 +1,150 @@
+package impl
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+func TestTCPLimits(t *testing.T) {
+	netln, err := TCP{}.Listen(net.ParseIP("127.0.0.1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := TCP{Limits: match.Limits{MaxConnsPerIP: 1}}.wrap(netln)
+	defer ln.Close()
+	addr := netln.Addr().String()
+
+	c1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	s1, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	// an excess conn is closed
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Error("expected an excess conn to be closed")
+	}
+
+	// closing an accepted conn frees a place
+	s1.Close()
+	s1.Close()
+
+	c3, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+
+	s3 := <-accepted
+	if _, ok := s3.(interface{ CloseWrite() error }); !ok {
+		t.Error("expected accepted conns to support half-close")
+	}
+	s3.Close()
+}
+
+func TestTCPReusePort(t *testing.T) {
+	tcp := TCP{ReusePort: true}
+	lo := net.ParseIP("127.0.0.1")
+
+	ln1, err := tcp.Listen(lo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+
+	ln2, err := tcp.Listen(lo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+
+	// dial ln2 from the port ln1 is listening on
+	tcp.LocalAddr = ln1.Addr().(*net.TCPAddr)
+	c, err := tcp.Dial(lo, ln2.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.LocalAddr().String() != ln1.Addr().String() {
+		t.Errorf("expected local addr %s, got %s", ln1.Addr(), c.LocalAddr())
+	}
+
+	// without ReusePort the port is taken
+	if _, err := (TCP{LocalAddr: tcp.LocalAddr}).Dial(lo, ln2.Addr().(*net.TCPAddr).Port); err == nil {
+		t.Error("expected dialing from a listening port to fail")
+	}
+}
+
+func TestTCPDialKey(t *testing.T) {
+	tcp := TCP{ReusePort: true}
+	lo := net.ParseIP("127.0.0.1")
+
+	ln1, err := tcp.Listen(lo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+
+	ln2, err := tcp.Listen(lo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+
+	m, err := ma.NewMultiaddr("/tcp/" + strconv.Itoa(ln2.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the registered TCP knows nothing of ln1
+	ctx := &testContext{values: map[interface{}]interface{}{}}
+	ctx.misc.IPs = []net.IP{lo}
+	TCPDialKey.Set(ctx, TCPDial{LocalAddr: ln1.Addr().(*net.TCPAddr), ReusePort: true})
+
+	if err := (TCP{}).Apply(m, match.S_Client, ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.special.Close()
+
+	if laddr := ctx.special.NetConn.LocalAddr(); laddr.String() != ln1.Addr().String() {
+		t.Errorf("expected local addr %s, got %s", ln1.Addr(), laddr)
+	}
+}
+
+// testContext is a minimal match.Context for applying a single MatchApplier.
+type testContext struct {
+	values  map[interface{}]interface{}
+	misc    match.MiscContext
+	special match.SpecialContext
+}
+
+func (ctx *testContext) Map() map[string]interface{}       { return nil }
+func (ctx *testContext) Value(key interface{}) interface{} { return ctx.values[key] }
+func (ctx *testContext) SetValue(key, val interface{})     { ctx.values[key] = val }
+func (ctx *testContext) Misc() *match.MiscContext          { return &ctx.misc }
+func (ctx *testContext) Special() *match.SpecialContext    { return &ctx.special }
+func (ctx *testContext) CopyTo(match.Context)              {}
+func (ctx *testContext) Reuse(match.Matcher)               {}
@@ -0,0 +1,67 @@
+package impl
+
+import (
+	"net"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+)
+
+// TCPOptions are socket options of dialed and accepted TCP connections. Zero
+// values leave the defaults of package net.
+type TCPOptions struct {
+	// KeepAlive is the keep-alive period, negative disables keep-alives.
+	KeepAlive time.Duration
+
+	// DisableNoDelay enables Nagle's algorithm, i.e. clears TCP_NODELAY.
+	DisableNoDelay bool
+
+	// Linger is the SO_LINGER timeout, rounded up to seconds. Negative
+	// discards unsent data on Close and resets the connection.
+	Linger time.Duration
+
+	// ReadBuffer and WriteBuffer are sizes of the socket buffers in bytes.
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// TCPOptionsKey overrides TCP.Options for a single Dial or Listen, if set in
+// the Context passed to them, e.g.
+//
+//	ctx := manet.NewContext()
+//	impl.TCPOptionsKey.Set(ctx, impl.TCPOptions{KeepAlive: time.Minute})
+//	c, err := manet.DialWithContext(m, ctx)
+var TCPOptionsKey = match.NewKey[TCPOptions]("impl/tcp.options")
+
+// apply sets o on c. KeepAlive is left to net.Dialer and net.ListenConfig.
+func (o TCPOptions) apply(c *net.TCPConn) error {
+	if o.DisableNoDelay {
+		if err := c.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+
+	if o.Linger < 0 {
+		if err := c.SetLinger(0); err != nil {
+			return err
+		}
+	} else if o.Linger > 0 {
+		sec := int((o.Linger + time.Second - 1) / time.Second)
+		if err := c.SetLinger(sec); err != nil {
+			return err
+		}
+	}
+
+	if o.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := c.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,23 +1,66 @@
 package impl
 
 import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/Gaboose/go-multiaddr-net/match"
 	"io"
 	"net"
 	"net/http"
-
-	"golang.org/x/net/websocket"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	ma "github.com/jbenet/go-multiaddr"
 )
 
 func init() {
-	ma.AddProtocol(ma.Protocol{481, -1, "ws", ma.CodeToVarint(481)})
+	ma.AddProtocol(ma.Protocol{Code: 481, Size: -1, Name: "ws", VCode: ma.CodeToVarint(481)})
 }
 
-type WS struct{}
+type WS struct {
+	// Compression enables the permessage-deflate extension. Nil disables it.
+	Compression *Deflate
+
+	// Backlog limits how many upgraded connections a listener queues until
+	// they're accepted. Further upgrade requests get a 503 response.
+	// Zero means DefaultWSBacklog.
+	Backlog int
+
+	// Stats, if set, holds the counters of each open listener of this WS.
+	// Listeners returned by Handle have their own, see WSStats.
+	Stats *WSListenerStats
+
+	// Limits of listeners. Excess upgrade requests get a 503 response, or
+	// a 429 if there are too many from the same IP. Connections from an IP
+	// are counted across all listeners sharing an /http server.
+	Limits match.Limits
+
+	// MaxMessageSize limits compressed messages, which are buffered whole
+	// before they're inflated. A larger one fails the connection with a
+	// close frame (1009, message too big). Zero means
+	// DefaultWSMaxMessageSize. Uncompressed messages are streamed, so any
+	// size is fine.
+	MaxMessageSize int64
+
+	// TrustedProxies are networks of reverse proxies, whose ForwardedHeader
+	// tells the client address of an upgrade request. Accepted connections
+	// report it as their RemoteAddr, which Limits count by, while PeerAddr
+	// is still the proxy's. The proxy is the peer of the connection the
+	// request came on, even if a /proxyproto header below tells otherwise.
+	TrustedProxies []*net.IPNet
+
+	// ForwardedHeader is the header, which TrustedProxies set, e.g.
+	// X-Forwarded-For or X-Real-IP. Others are ignored, since clients could
+	// send them through the proxy. Empty means Forwarded (RFC 7239).
+	ForwardedHeader string
+}
 
 func (w WS) Match(m ma.Multiaddr, side int) (int, bool) {
 	ps := m.Protocols()
@@ -36,16 +79,20 @@ func (w WS) Match(m ma.Multiaddr, side int) (int, bool) {
 	return 0, false
 }
 
+func (w WS) Protocols(side int) []string {
+	if side == match.S_Client {
+		// as in /http/ws
+		return []string{"http", "ws"}
+	}
+	return []string{"ws"}
+}
+
 func (w WS) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
 	var path string
 	// ws client matches /http/ws too, so /ws might not be the first protocol
 	for _, p := range m.Protocols() {
 		if p.Name == "ws" {
-			pth, err := m.ValueForProtocol(p.Code)
-			if err != nil {
-				return err
-			}
-			path = pth
+			path = protocolValue(m, p)
 			break
 		}
 	}
@@ -70,24 +117,42 @@ func (w WS) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
 			}
 		}
 
-		wcon, err := w.Select(sctx.NetConn, url)
+		if sctx.NetConn == nil {
+			return fmt.Errorf("no connection to upgrade to websocket")
+		}
+		wcon, err := w.handshake(sctx.NetConn, url)
 		if err != nil {
 			return err
 		}
 		sctx.NetConn = wcon
+		// say goodbye before the conns underneath are closed
+		sctx.PushClose(wcon.sendClose)
 		return nil
 
 	case match.S_Server:
 		if mctx.HTTPMux == nil {
 			// help the user out if /http is missing before /ws
-			HTTP{}.Apply(m, match.S_Server, ctx)
+			if err := (HTTP{}).Apply(m, match.S_Server, ctx); err != nil {
+				return err
+			}
 		}
-		ln, err := w.Handle(mctx.HTTPMux, "/"+path)
+		ln, err := w.handle(mctx.HTTPMux, "/"+path)
 		if err != nil {
 			return err
 		}
 		sctx.NetListener = ln
-		sctx.CloseFn = ConcatClose(ln.Close, sctx.CloseFn)
+		sctx.PushClose(ln.Close)
+		if w.Stats != nil {
+			addr := listenerAddr(sctx.PreAddr, m)
+			stats := ln.Stats()
+			w.Stats.add(addr, stats)
+			sctx.PushClose(func() error {
+				w.Stats.remove(addr, stats)
+				return nil
+			})
+		}
+		// the mux serves this level, protocols above get their own
+		mctx.HTTPMux = nil
 		return nil
 
 	}
@@ -95,26 +160,190 @@ func (w WS) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
 	return fmt.Errorf("incorrect side constant")
 }
 
-func (w WS) Select(netcon net.Conn, url string) (*websocket.Conn, error) {
-	conf, err := websocket.NewConfig(url, url)
+// Select performs a WebSocket client handshake on netcon and returns the
+// resulting connection. If w.Compression is set, permessage-deflate is offered
+// and used when the server accepts it.
+func (w WS) Select(netcon net.Conn, url string) (net.Conn, error) {
+	c, err := w.handshake(netcon, url)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (w WS) handshake(netcon net.Conn, url string) (*wsconn, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newWSKey()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+			"Origin":                {url},
+		},
+	}
+	if w.Compression != nil {
+		req.Header.Set("Sec-WebSocket-Extensions", w.Compression.offer())
+	}
+
+	if err := req.Write(netcon); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(netcon)
+	resp, err := http.ReadResponse(br, req)
 	if err != nil {
 		return nil, err
 	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket: bad handshake status %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") {
+
+		return nil, fmt.Errorf("websocket: bad upgrade headers")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, fmt.Errorf("websocket: bad Sec-WebSocket-Accept")
+	}
+
+	var d *deflateConn
+	if w.Compression != nil {
+		params, ok, err := w.Compression.negotiated(resp.Header)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			d, err = params.conn(true, w.Compression.Level)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if resp.Header.Get("Sec-WebSocket-Extensions") != "" {
+		return nil, fmt.Errorf("websocket: unexpected extensions in response")
+	}
+
+	return newWSConn(netcon, br, true, d, w.maxMessageSize()), nil
+}
+
+// upgrade performs the server side of the WebSocket handshake. If it fails,
+// it has already responded to the client.
+func (w WS) upgrade(rw http.ResponseWriter, r *http.Request) (*wsconn, error) {
+	if r.Method != "GET" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("websocket: bad method %s", r.Method)
+	}
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(r.Header, "Connection", "upgrade") {
+
+		http.Error(rw, "not a websocket handshake", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: not a websocket handshake")
+	}
 
-	wcon, err := websocket.NewClient(conf, netcon)
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(rw, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("websocket: unsupported version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(rw, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: missing key")
+	}
+
+	var ext string
+	var params deflateParams
+	compress := false
+	if w.Compression != nil {
+		ext, params, compress = w.Compression.accept(r.Header)
+	}
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "can't hijack connection", http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket: response can't be hijacked")
+	}
+
+	netcon, brw, err := hj.Hijack()
 	if err != nil {
 		return nil, err
 	}
 
-	return wcon, nil
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	brw.WriteString("Upgrade: websocket\r\n")
+	brw.WriteString("Connection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n")
+	if compress {
+		brw.WriteString("Sec-WebSocket-Extensions: " + ext + "\r\n")
+	}
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		netcon.Close()
+		return nil, err
+	}
+
+	var d *deflateConn
+	if compress {
+		d, err = params.conn(false, w.Compression.Level)
+		if err != nil {
+			netcon.Close()
+			return nil, err
+		}
+	}
+
+	return newWSConn(netcon, brw.Reader, false, d, w.maxMessageSize()), nil
+}
+
+// DefaultWSMaxMessageSize is the MaxMessageSize of a WS with zero.
+const DefaultWSMaxMessageSize = 32 << 20
+
+func (w WS) maxMessageSize() int64 {
+	if w.MaxMessageSize > 0 {
+		return w.MaxMessageSize
+	}
+	return DefaultWSMaxMessageSize
 }
 
 func (w WS) Handle(mux *match.ServeMux, pattern string) (net.Listener, error) {
+	ln, err := w.handle(mux, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (w WS) handle(mux *match.ServeMux, pattern string) (*wslistener, error) {
+
+	backlog := w.Backlog
+	if backlog <= 0 {
+		backlog = DefaultWSBacklog
+	}
 
 	closeCh := make(chan struct{})
 	ln := &wslistener{
-		make(chan net.Conn),
-		closeCh,
+		ws:       w,
+		mux:      mux,
+		acceptCh: make(chan net.Conn, backlog),
+		closeCh:  closeCh,
 	}
 
 	var err error
@@ -134,77 +363,266 @@ func (w WS) Handle(mux *match.ServeMux, pattern string) (net.Listener, error) {
 	return ln, nil
 }
 
+// DefaultWSBacklog is the accept backlog of WS listeners with zero Backlog.
+const DefaultWSBacklog = 128
+
+// WSStats counts connections of a single listener. Listeners returned by
+// WS.Handle have a Stats method returning theirs.
+type WSStats struct {
+	queued   int64
+	rejected int64
+}
+
+// Queued returns the number of upgraded connections waiting for Accept.
+func (s *WSStats) Queued() int64 { return atomic.LoadInt64(&s.queued) }
+
+// Rejected returns the number of upgrades refused because of a full backlog
+// or exceeded limits.
+func (s *WSStats) Rejected() int64 { return atomic.LoadInt64(&s.rejected) }
+
+func (s *WSStats) addQueued(d int64) { atomic.AddInt64(&s.queued, d) }
+func (s *WSStats) addRejected()      { atomic.AddInt64(&s.rejected, 1) }
+
+// WSListenerStats holds WSStats of open listeners by the multiaddr they
+// listen on, e.g. /ip4/0.0.0.0/tcp/80/http/ws/foo.
+type WSListenerStats struct {
+	mu sync.Mutex
+	m  map[string]*WSStats
+}
+
+// Listener returns the stats of the listener on addr, or nil if there's no
+// such listener open.
+func (s *WSListenerStats) Listener(addr string) *WSStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[addr]
+}
+
+// Addrs returns the addresses of open listeners in sorted order.
+func (s *WSListenerStats) Addrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]string, 0, len(s.m))
+	for a := range s.m {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (s *WSListenerStats) add(addr string, stats *WSStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.m == nil {
+		s.m = map[string]*WSStats{}
+	}
+	s.m[addr] = stats
+}
+
+func (s *WSListenerStats) remove(addr string, stats *WSStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a listener on the same addr might have taken the place already
+	if s.m[addr] == stats {
+		delete(s.m, addr)
+	}
+}
+
+// listenerAddr returns the multiaddr of a listener created by applying the
+// first protocol of m after pre, which may be nil.
+func listenerAddr(pre, m ma.Multiaddr) string {
+	head := ma.Split(m)[0]
+	if pre == nil {
+		return head.String()
+	}
+	return pre.Encapsulate(head).String()
+}
+
 type wslistener struct {
-	acceptCh chan net.Conn
+	ws       WS
+	stats    WSStats
+	mux      *match.ServeMux // counts conns per IP across listeners
+	conns    match.ConnCounter
+	acceptCh chan net.Conn // upgraded conns waiting for Accept
 	closeCh  chan struct{}
+
+	mu       sync.Mutex
+	reserved int // upgrades in progress, each holds a place in acceptCh
+	closed   bool
 }
 
-func (ln wslistener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	websocket.Handler(func(wcon *websocket.Conn) {
+func (ln *wslistener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	header := ln.ws.ForwardedHeader
+	if header == "" {
+		header = "Forwarded"
+	}
+	fwd := forwardedAddr(r, peerAddr(r), header, ln.ws.TrustedProxies)
+	if fwd != nil {
+		ip = fwd.IP.String()
+	}
+	if err := ln.acquire(ip); err != nil {
+		status := http.StatusServiceUnavailable
+		if err == match.ErrTooManyConnsFromIP {
+			status = http.StatusTooManyRequests
+		}
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if !ln.reserve() {
+		ln.release(ip)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "accept backlog is full", http.StatusServiceUnavailable)
+		return
+	}
 
-		// It appears we mustn't pass wcon to external users as is.
-		// We'll pass a pipe instead, because the only way to know if a wcon
-		// was closed remotely is to read from it until EOF.
-		//
-		// See below for why we need to know when wcon is closed remotely.
+	wcon, err := ln.ws.upgrade(w, r)
 
-		ch := make(chan struct{})
-		p1, p2 := net.Pipe()
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.reserved--
 
-		go func() {
-			io.Copy(wcon, p1)
-			wcon.Close()
-		}()
-		go func() {
-			io.Copy(p1, wcon)
-			p1.Close()
+	if err != nil {
+		ln.release(ip)
+		return
+	}
+	wcon.onClose = func() { ln.release(ip) }
+	if fwd != nil {
+		wcon.raddr = fwd
+	}
 
-			close(ch)
-		}()
+	// wcon is hijacked from the http server, so we may return as soon as
+	// it's queued, instead of holding a goroutine until Accept
+	if ln.closed {
+		wcon.Close()
+		return
+	}
+	ln.acceptCh <- wcon // never blocks, we've reserved a place
+	ln.stats.addQueued(1)
+}
 
-		select {
-		case ln.acceptCh <- p2:
-		case <-ln.closeCh:
-		}
+// acquire counts a conn from ip against ln.ws.Limits.
+func (ln *wslistener) acquire(ip string) error {
+	lim := ln.ws.Limits
+	if err := ln.conns.Acquire(ip, lim.MaxConns, 0); err != nil {
+		ln.stats.addRejected()
+		return err
+	}
+	if err := ln.mux.Conns.Acquire(ip, 0, lim.MaxConnsPerIP); err != nil {
+		ln.conns.Release(ip)
+		ln.stats.addRejected()
+		return err
+	}
+	return nil
+}
 
-		// As soon as we return from this function, websocket library will
-		// close wcon. So we'll wait until p2 or wcon is closed.
-		<-ch
+func (ln *wslistener) release(ip string) {
+	ln.mux.Conns.Release(ip)
+	ln.conns.Release(ip)
+}
 
-	}).ServeHTTP(w, r)
+// reserve takes a place in the backlog, or reports that it's full.
+func (ln *wslistener) reserve() bool {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if ln.closed || ln.reserved+len(ln.acceptCh) >= cap(ln.acceptCh) {
+		ln.stats.addRejected()
+		return false
+	}
+	ln.reserved++
+	return true
 }
 
-func (ln wslistener) Accept() (net.Conn, error) {
+func (ln *wslistener) Accept() (net.Conn, error) {
 	select {
 	case c := <-ln.acceptCh:
+		ln.stats.addQueued(-1)
 		return c, nil
 	case <-ln.closeCh:
 		return nil, errors.New("listener is closed")
 	}
 }
 
-func (ln wslistener) Close() error {
-	var err error
-	func() {
-		defer recoverToError(
-			&err,
-			fmt.Errorf("listener is already closed"),
-		)
-		close(ln.closeCh)
-	}()
-	return err
+func (ln *wslistener) Close() error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if ln.closed {
+		return fmt.Errorf("listener is already closed")
+	}
+	ln.closed = true
+	close(ln.closeCh)
+
+	// nobody is going to accept the queued conns
+	for {
+		select {
+		case c := <-ln.acceptCh:
+			ln.stats.addQueued(-1)
+			c.Close()
+		default:
+			return nil
+		}
+	}
 }
 
-func (ln wslistener) Addr() net.Addr { return nil }
+func (ln *wslistener) Addr() net.Addr { return nil }
+
+// Stats returns the counters of ln.
+func (ln *wslistener) Stats() *WSStats { return &ln.stats }
 
+// ConcatClose returns a function calling f1 and then f2, which returns
+// a match.MultiError if either fails. Either may be nil.
+//
+// Deprecated: push close functions with SpecialContext.PushClose instead.
 func ConcatClose(f1, f2 func() error) func() error {
 	return func() error {
-		err := f1()
-		err = f2()
-		return err
+		var errs match.MultiError
+		for _, f := range []func() error{f1, f2} {
+			if f == nil {
+				continue
+			}
+			if err := f(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) == 0 {
+			return nil
+		}
+		return errs
 	}
 }
 
+// firstProtocol returns the first protocol of m, or an error if m is empty.
+func firstProtocol(m ma.Multiaddr) (ma.Protocol, error) {
+	ps := m.Protocols()
+	if len(ps) == 0 {
+		return ma.Protocol{}, fmt.Errorf("empty multiaddr")
+	}
+	return ps[0], nil
+}
+
+// protocolValue returns the value following p in m, like
+// m.ValueForProtocol, but an empty one doesn't make it panic.
+func protocolValue(m ma.Multiaddr, p ma.Protocol) string {
+	for _, sub := range ma.Split(m) {
+		if sub.Protocols()[0].Code != p.Code {
+			continue
+		}
+		parts := strings.SplitN(sub.String(), "/", 3)
+		if len(parts) < 3 {
+			return ""
+		}
+		return parts[2]
+	}
+	return ""
+}
+
 func recoverToError(maybeErr *error, err error) {
 	if r := recover(); r != nil {
 		if err != nil {
@@ -214,3 +632,32 @@ func recoverToError(maybeErr *error, err error) {
 		}
 	}
 }
+
+// RFC 6455 magic value for computing Sec-WebSocket-Accept
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func newWSKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains reports whether a comma separated header contains token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
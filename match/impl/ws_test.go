@@ -0,0 +1,550 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	ma "github.com/jbenet/go-multiaddr"
+	"golang.org/x/net/websocket"
+)
+
+func TestWSCompression(t *testing.T) {
+	cases := []struct {
+		name       string
+		client     *Deflate
+		server     *Deflate
+		negotiated bool
+	}{
+		{"both", &Deflate{}, &Deflate{}, true},
+		{"level", &Deflate{Level: flate.BestSpeed}, &Deflate{Level: flate.BestCompression}, true},
+		{"client no takeover", &Deflate{ClientNoContextTakeover: true}, &Deflate{}, true},
+		{"server no takeover", &Deflate{}, &Deflate{ServerNoContextTakeover: true}, true},
+		{"server only", nil, &Deflate{}, false},
+		{"client only", &Deflate{}, nil, false},
+	}
+
+	for _, c := range cases {
+		ln, addr := wsServer(t, WS{Compression: c.server})
+
+		netcon, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		con, err := WS{Compression: c.client}.Select(netcon, "ws://"+addr+"/echo")
+		if err != nil {
+			t.Errorf("%s: Select err: %s", c.name, err)
+			ln.Close()
+			continue
+		}
+
+		if got := con.(*wsconn).deflate != nil; got != c.negotiated {
+			t.Errorf("%s: expected negotiated %v, got %v", c.name, c.negotiated, got)
+		}
+
+		go echoAll(ln)
+		assertEchoMessages(t, c.name, con)
+
+		con.Close()
+		ln.Close()
+	}
+}
+
+func TestWSCompressionFallback(t *testing.T) {
+	// a server that doesn't know about extensions
+	netln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netln.Close()
+
+	go http.Serve(netln, websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+
+	addr := netln.Addr().String()
+	netcon, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con, err := WS{Compression: &Deflate{}}.Select(netcon, "ws://"+addr+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+
+	if con.(*wsconn).deflate != nil {
+		t.Error("expected no compression")
+	}
+	assertEchoMessages(t, "fallback", con)
+}
+
+func TestWSDeadlineResume(t *testing.T) {
+	ln, addr := wsServer(t, WS{Compression: &Deflate{}})
+	defer ln.Close()
+
+	netcon, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con, err := WS{Compression: &Deflate{}}.Select(netcon, "ws://"+addr+"/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+
+	con.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = con.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	con.SetReadDeadline(time.Time{})
+
+	go echoAll(ln)
+	assertEchoMessages(t, "resume", con)
+}
+
+func TestWSBacklog(t *testing.T) {
+	ln, addr := wsServer(t, WS{Backlog: 1})
+	defer ln.Close()
+	stats := ln.(closeBoth).Listener.(interface {
+		Stats() *WSStats
+	}).Stats()
+
+	dial := func() (net.Conn, error) {
+		netcon, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return WS{}.Select(netcon, "ws://"+addr+"/echo")
+	}
+
+	c1, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	_, err = dial()
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected a 503 error, got %v", err)
+	}
+
+	if stats.Queued() != 1 || stats.Rejected() != 1 {
+		t.Errorf("expected 1 queued and 1 rejected, got %d and %d", stats.Queued(), stats.Rejected())
+	}
+
+	// accepting frees a place
+	go echoAll(ln)
+	assertEchoMessages(t, "backlog", c1)
+
+	if stats.Queued() != 0 {
+		t.Errorf("expected an empty queue, got %d", stats.Queued())
+	}
+
+	c2, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	// closing the listener closes queued conns
+	ln.Close()
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF on a queued conn, got %v", err)
+	}
+}
+
+func TestWSDeflateAccept(t *testing.T) {
+	cases := []struct {
+		offer string
+		resp  string
+		ok    bool
+	}{
+		{"permessage-deflate", "permessage-deflate", true},
+		{"permessage-deflate; client_max_window_bits", "permessage-deflate", true},
+		{"permessage-deflate; server_no_context_takeover", "permessage-deflate; server_no_context_takeover", true},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", "permessage-deflate", true},
+		{"permessage-deflate; server_max_window_bits=10", "", false},
+		{"permessage-deflate; foo", "", false},
+		{"permessage-deflate; foo; server_max_window_bits=15", "", false},
+		{"permessage-deflate; server_max_window_bits=15; foo", "", false},
+		{"x-webkit-deflate-frame", "", false},
+	}
+
+	for _, c := range cases {
+		h := http.Header{"Sec-Websocket-Extensions": {c.offer}}
+		resp, _, ok := Deflate{}.accept(h)
+		if ok != c.ok || resp != c.resp {
+			t.Errorf("accept(%q) = %q, %v, expected %q, %v", c.offer, resp, ok, c.resp, c.ok)
+		}
+	}
+}
+
+func TestWSListenerStats(t *testing.T) {
+	netln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netln.Close()
+
+	mux := match.NewServeMux()
+	go (&http.Server{Handler: mux}).Serve(netln)
+
+	pre, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/80/http")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two listeners of the same WS on one server
+	w := WS{Backlog: 1, Stats: &WSListenerStats{}}
+	var ctxs []*testContext
+	for _, path := range []string{"a", "b"} {
+		m, err := ma.NewMultiaddr("/ws/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := &testContext{values: map[interface{}]interface{}{}}
+		ctx.misc.HTTPMux = mux
+		ctx.special.PreAddr = pre
+		if err := w.Apply(m, match.S_Server, ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer ctx.special.Close()
+		ctxs = append(ctxs, ctx)
+	}
+
+	addrs := w.Stats.Addrs()
+	if strings.Join(addrs, " ") != "/ip4/127.0.0.1/tcp/80/http/ws/a /ip4/127.0.0.1/tcp/80/http/ws/b" {
+		t.Fatalf("unexpected listener addrs %v", addrs)
+	}
+
+	// fill the backlog of /ws/a and overflow it
+	for i := 0; i < 2; i++ {
+		netcon, err := net.Dial("tcp", netln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer netcon.Close()
+		WS{}.Select(netcon, "ws://"+netln.Addr().String()+"/a")
+	}
+
+	a, b := w.Stats.Listener(addrs[0]), w.Stats.Listener(addrs[1])
+	if a.Queued() != 1 || a.Rejected() != 1 {
+		t.Errorf("/ws/a: expected 1 queued and 1 rejected, got %d and %d", a.Queued(), a.Rejected())
+	}
+	if b.Queued() != 0 || b.Rejected() != 0 {
+		t.Errorf("/ws/b: expected no conns, got %d queued and %d rejected", b.Queued(), b.Rejected())
+	}
+
+	// closed listeners are dropped
+	ctxs[0].special.Close()
+	if w.Stats.Listener(addrs[0]) != nil || w.Stats.Listener(addrs[1]) != b {
+		t.Error("expected only the stats of the open listener")
+	}
+}
+
+func wsServer(t *testing.T, w WS) (net.Listener, string) {
+	netln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := match.NewServeMux()
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(netln)
+
+	ln, err := w.Handle(mux, "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return closeBoth{ln, netln}, netln.Addr().String()
+}
+
+type closeBoth struct {
+	net.Listener
+	under net.Listener
+}
+
+func (c closeBoth) Close() error {
+	c.Listener.Close()
+	return c.under.Close()
+}
+
+func echoAll(ln net.Listener) {
+	c, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	io.Copy(c, c)
+	c.Close()
+}
+
+// assertEchoMessages sends a few messages, including repeated ones to make use
+// of context takeover, and expects to read them back.
+func assertEchoMessages(t *testing.T, name string, c net.Conn) {
+	msgs := []string{
+		"hello",
+		strings.Repeat("compressible ", 1000),
+		strings.Repeat("compressible ", 1000),
+		"",
+		"hello",
+	}
+
+	for _, msg := range msgs {
+		if _, err := io.WriteString(c, msg); err != nil {
+			t.Errorf("%s: write err: %s", name, err)
+			return
+		}
+
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Errorf("%s: read err: %s", name, err)
+			return
+		}
+		if !bytes.Equal(buf, []byte(msg)) {
+			t.Errorf("%s: expected %d bytes echoed, got a different %d", name, len(msg), len(buf))
+		}
+	}
+}
+
+func TestWSLimits(t *testing.T) {
+	netln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netln.Close()
+	addr := netln.Addr().String()
+
+	mux := match.NewServeMux()
+	go http.Serve(netln, mux)
+
+	// two listeners sharing per IP counts on the same mux
+	ln1, err := WS{Limits: match.Limits{MaxConnsPerIP: 2}}.Handle(mux, "/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	ln2, err := WS{Limits: match.Limits{MaxConns: 1, MaxConnsPerIP: 2}}.Handle(mux, "/two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+
+	dial := func(path string) (net.Conn, error) {
+		netcon, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return WS{}.Select(netcon, "ws://"+addr+path)
+	}
+
+	c1, err := dial("/two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	// per listener
+	if _, err := dial("/two"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected a 503 error, got %v", err)
+	}
+
+	c2, err := dial("/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	// per IP, counting c1 from the other listener
+	if _, err := dial("/one"); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("expected a 429 error, got %v", err)
+	}
+
+	// closing an accepted conn frees a place
+	s1, err := ln2.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1.Close()
+
+	c3, err := dial("/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c3.Close()
+}
+
+func TestWSTrustedProxies(t *testing.T) {
+	netln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netln.Close()
+	addr := netln.Addr().String()
+
+	mux := match.NewServeMux()
+	go http.Serve(netln, mux)
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	trusting, err := WS{TrustedProxies: []*net.IPNet{loopback}, ForwardedHeader: "X-Forwarded-For"}.Handle(mux, "/trusting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trusting.Close()
+	// trusts Forwarded, which isn't sent
+	other, err := WS{TrustedProxies: []*net.IPNet{loopback}}.Handle(mux, "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	plain, err := WS{}.Handle(mux, "/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	for _, c := range []struct {
+		ln    net.Listener
+		path  string
+		raddr string // empty for the peer's
+	}{
+		{trusting, "/trusting", "203.0.113.7:0"},
+		{other, "/other", ""},
+		{plain, "/plain", ""},
+	} {
+		netcon, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer netcon.Close()
+
+		config, err := websocket.NewConfig("ws://"+addr+c.path, "http://localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Header.Set("X-Forwarded-For", "203.0.113.7")
+		if _, err := websocket.NewClient(config, netcon); err != nil {
+			t.Fatal(err)
+		}
+
+		sc, err := c.ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sc.Close()
+
+		peer := netcon.LocalAddr().String()
+		expected := c.raddr
+		if expected == "" {
+			expected = peer
+		}
+		if got := sc.RemoteAddr().String(); got != expected {
+			t.Errorf("%s: expected RemoteAddr %s, got %s", c.path, expected, got)
+		}
+		if got := sc.(*wsconn).PeerAddr().String(); got != peer {
+			t.Errorf("%s: expected PeerAddr %s, got %s", c.path, peer, got)
+		}
+	}
+}
+
+func TestWSTrustedProxiesPeer(t *testing.T) {
+	netln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netln.Close()
+	addr := netln.Addr().String()
+
+	// a balancer at loopback tells the client is 10.0.0.5, which the /ws
+	// listener would trust, if it went by RemoteAddr
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	mux := HTTP{}.Server(ProxyProto{TrustedProxies: []*net.IPNet{loopback}}.Wrap(netln))
+	ln, err := WS{TrustedProxies: []*net.IPNet{proxies}, ForwardedHeader: "X-Forwarded-For"}.Handle(mux, "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	netcon, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netcon.Close()
+	netcon.Write([]byte("PROXY TCP4 10.0.0.5 127.0.0.1 5678 80\r\n"))
+
+	config, err := websocket.NewConfig("ws://"+addr+"/echo", "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if _, err := websocket.NewClient(config, netcon); err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	if got, expected := sc.RemoteAddr().String(), "10.0.0.5:5678"; got != expected {
+		t.Errorf("expected RemoteAddr %s, got %s", expected, got)
+	}
+}
+
+func TestWSFrameChecks(t *testing.T) {
+	d, err := deflateParams{}.conn(false, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		client bool
+		frame  []byte
+		code   int
+	}{
+		// a compressed message claiming 2^40 bytes is refused up front
+		{"too big", false, []byte{0xc2, 0x80 | 127, 0, 0, 1, 0, 0, 0, 0, 0, 1, 2, 3, 4}, closeTooBig},
+		{"unmasked from client", false, []byte{0x82, 1, 'x'}, closeProtocolError},
+		{"masked from server", true, []byte{0x82, 0x80 | 1, 1, 2, 3, 4, 'x'}, closeProtocolError},
+	}
+
+	for _, c := range cases {
+		c1, c2 := memPipe(MemoryAddr("a"), MemoryAddr("b"))
+		ws := newWSConn(c1, nil, c.client, d, 1024)
+		c2.Write(c.frame)
+
+		if _, err := ws.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: expected a read error", c.name)
+		}
+
+		// the peer is told why
+		c2.SetReadDeadline(time.Now().Add(time.Second))
+		br := bufio.NewReader(c2)
+		h, n, err := peekFrameHeader(br)
+		if err != nil {
+			t.Fatalf("%s: reading the close frame: %s", c.name, err)
+		}
+		br.Discard(n)
+		payload := make([]byte, h.length)
+		io.ReadFull(br, payload)
+		h.unmask(payload, 0)
+		if code := int(payload[0])<<8 | int(payload[1]); h.op != opClose || code != c.code {
+			t.Errorf("%s: expected a close frame with %d, got %d, % x", c.name, c.code, h.op, payload)
+		}
+
+		ws.Close()
+		c2.Close()
+	}
+}
@@ -0,0 +1,525 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// WebSocket opcodes and close codes from RFC 6455
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+)
+
+var (
+	errWSClosed = errors.New("websocket is closed")
+	errWSTooBig = errors.New("websocket: message too big")
+)
+
+// wsconn is a net.Conn speaking the WebSocket protocol (RFC 6455) on top of
+// another net.Conn. Each Write is sent as a single binary message, while Read
+// returns payloads of incoming messages as one continuous stream.
+type wsconn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // client frames have to be masked
+
+	// read side, guarded by rmu
+	rmu  sync.Mutex
+	msg  io.Reader // payload of the current message, nil between messages
+	rerr error     // sticky, except for timeouts
+
+	// write side, guarded by wmu
+	wmu       sync.Mutex
+	closeSent bool
+	werr      error // set if a frame may have been written partially
+
+	// permessage-deflate state, nil if the extension wasn't negotiated
+	deflate *deflateConn
+
+	// maxMessage limits the size of buffered compressed messages
+	maxMessage int64
+
+	// onClose, if set, is called by the first Close
+	onClose   func()
+	closeOnce sync.Once
+
+	// raddr, if set, is the client address forwarded by a trusted proxy
+	raddr net.Addr
+}
+
+func newWSConn(netcon net.Conn, br *bufio.Reader, client bool, d *deflateConn, maxMessage int64) *wsconn {
+	if br == nil {
+		br = bufio.NewReader(netcon)
+	}
+	return &wsconn{Conn: netcon, br: br, client: client, deflate: d, maxMessage: maxMessage}
+}
+
+func (c *wsconn) RemoteAddr() net.Addr {
+	if c.raddr != nil {
+		return c.raddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// PeerAddr returns the address of the other end of the connection below,
+// or of the proxy behind it, which may differ from RemoteAddr.
+func (c *wsconn) PeerAddr() net.Addr {
+	if pa, ok := c.Conn.(interface {
+		PeerAddr() net.Addr
+	}); ok {
+		return pa.PeerAddr()
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *wsconn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+
+		if c.msg == nil {
+			msg, err := c.nextMessage()
+			if err != nil {
+				return 0, c.readErr(err)
+			}
+			c.msg = msg
+		}
+
+		n, err := c.msg.Read(b)
+		if err == io.EOF {
+			// end of message, proceed to the next one unless we have data
+			c.msg = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if err != nil {
+			err = c.readErr(err)
+		}
+		return n, err
+	}
+}
+
+// readErr makes err sticky, unless it's a timeout. Frames are never consumed
+// partially on a timeout, so reading may resume after the deadline is moved.
+func (c *wsconn) readErr(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return err
+	}
+	c.rerr = err
+	return err
+}
+
+// nextMessage reads frames until a data frame starts a new message, handling
+// any control frames on the way. It returns io.EOF if a close frame arrives.
+func (c *wsconn) nextMessage() (io.Reader, error) {
+	for {
+		h, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch h.op {
+		case opText, opBinary:
+			fr := &frameReader{c: c, h: h}
+			if !h.rsv1 {
+				return fr, nil
+			}
+			if c.deflate == nil {
+				return nil, fmt.Errorf("websocket: compressed frame without negotiated extension")
+			}
+			fr.limit = c.maxMessage
+			if err := fr.checkLimit(); err != nil {
+				return nil, err
+			}
+			return &deflateMessage{c: c, fr: fr}, nil
+
+		case opContinuation:
+			return nil, fmt.Errorf("websocket: unexpected continuation frame")
+
+		default:
+			if err := c.handleControl(h, payload); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// readFrame consumes the next frame header. For control frames it also
+// consumes and returns the unmasked payload.
+//
+// Nothing is consumed if an error occurs, so a read timeout can't leave us in
+// the middle of a header.
+func (c *wsconn) readFrame() (frameHeader, []byte, error) {
+	h, n, err := peekFrameHeader(c.br)
+	if err != nil {
+		return h, nil, err
+	}
+
+	// clients mask their frames and servers don't (RFC 6455, section 5.1)
+	if h.masked == c.client {
+		c.fail(closeProtocolError, "bad masking")
+		if c.client {
+			return h, nil, fmt.Errorf("websocket: masked frame from server")
+		}
+		return h, nil, fmt.Errorf("websocket: unmasked frame from client")
+	}
+
+	if h.op < opClose {
+		c.br.Discard(n)
+		return h, nil, nil
+	}
+
+	if !h.fin || h.length > 125 {
+		return h, nil, fmt.Errorf("websocket: invalid control frame")
+	}
+
+	b, err := c.br.Peek(n + int(h.length))
+	if err != nil {
+		return h, nil, err
+	}
+	payload := append([]byte{}, b[n:]...)
+	h.unmask(payload, 0)
+	c.br.Discard(len(b))
+
+	return h, payload, nil
+}
+
+// handleControl reacts to a control frame.
+func (c *wsconn) handleControl(h frameHeader, payload []byte) error {
+	switch h.op {
+	case opPing:
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		if c.closeSent {
+			return nil
+		}
+		return c.writeFrame(opPong, false, payload)
+	case opPong:
+		return nil
+	case opClose:
+		// Report the end of the stream, but don't echo the close frame yet.
+		// Like with a TCP half-close, we may still have something to write,
+		// so the reply is sent by CloseWrite or Close.
+		return io.EOF
+	}
+
+	return fmt.Errorf("websocket: unknown opcode %d", h.op)
+}
+
+func (c *wsconn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return 0, errWSClosed
+	}
+
+	payload := b
+	compressed := false
+	if c.deflate != nil {
+		var err error
+		payload, err = c.deflate.compress(b)
+		if err != nil {
+			return 0, err
+		}
+		compressed = true
+	}
+
+	if err := c.writeFrame(opBinary, compressed, payload); err != nil {
+		if compressed {
+			// the peer's inflater would fall out of sync with our compressor
+			c.werr = err
+		}
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite starts the closing handshake by sending a close frame. Reading
+// goes on until the peer replies with its own close frame.
+func (c *wsconn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return errWSClosed
+	}
+	c.closeSent = true
+	return c.writeFrame(opClose, false, closePayload(closeNormal))
+}
+
+// fail sends a close frame with code and reason, unless one was already sent,
+// after a violation by the peer.
+func (c *wsconn) fail(code int, reason string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if !c.closeSent {
+		c.closeSent = true
+		c.writeFrame(opClose, false, append(closePayload(code), reason...))
+	}
+}
+
+// sendClose sends a close frame, unless one was already sent.
+func (c *wsconn) sendClose() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	return c.writeFrame(opClose, false, closePayload(closeNormal))
+}
+
+// Close sends a close frame, unless one was already sent, and closes the
+// underlying connection.
+func (c *wsconn) Close() error {
+	c.sendClose()
+	err := c.Conn.Close()
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	return err
+}
+
+// writeFrame writes a single final frame. Callers must hold c.wmu.
+func (c *wsconn) writeFrame(op byte, rsv1 bool, payload []byte) error {
+	if c.werr != nil {
+		return c.werr
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+
+	b0 := byte(0x80) | op
+	if rsv1 {
+		b0 |= 0x40
+	}
+	buf = append(buf, b0)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(n))
+	default:
+		buf = append(buf, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(n))
+	}
+
+	if c.client {
+		var key [4]byte
+		if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+
+		// mask a copy, the caller still owns payload
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(key, 0, buf[start:])
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	n, err := c.Conn.Write(buf)
+	if err != nil && n > 0 {
+		// e.g. a write timeout in the middle of a frame; there's no way to
+		// recover framing after that
+		c.werr = err
+	}
+	return err
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	op     byte
+	length int64
+	masked bool
+	key    [4]byte
+}
+
+// peekFrameHeader parses the frame header at the start of br without
+// consuming it. n is the length of the header.
+func peekFrameHeader(br *bufio.Reader) (h frameHeader, n int, err error) {
+	b, err := br.Peek(2)
+	if err != nil {
+		return h, 0, err
+	}
+
+	h.fin = b[0]&0x80 != 0
+	h.rsv1 = b[0]&0x40 != 0
+	h.op = b[0] & 0x0f
+	if b[0]&0x30 != 0 {
+		return h, 0, fmt.Errorf("websocket: unexpected reserved bits")
+	}
+
+	h.masked = b[1]&0x80 != 0
+	length := b[1] & 0x7f
+
+	n = 2
+	switch length {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if h.masked {
+		n += 4
+	}
+
+	if b, err = br.Peek(n); err != nil {
+		return h, 0, err
+	}
+
+	switch length {
+	case 126:
+		h.length = int64(binary.BigEndian.Uint16(b[2:4]))
+	case 127:
+		h.length = int64(binary.BigEndian.Uint64(b[2:10]))
+		if h.length < 0 {
+			return h, 0, fmt.Errorf("websocket: invalid frame length")
+		}
+	default:
+		h.length = int64(length)
+	}
+
+	if h.masked {
+		copy(h.key[:], b[n-4:n])
+	}
+
+	return h, n, nil
+}
+
+// unmask unmasks b in place, pos being the offset of b within the payload.
+func (h frameHeader) unmask(b []byte, pos int64) {
+	if h.masked {
+		maskBytes(h.key, pos, b)
+	}
+}
+
+func maskBytes(key [4]byte, pos int64, b []byte) {
+	for i := range b {
+		b[i] ^= key[(pos+int64(i))%4]
+	}
+}
+
+func closePayload(code int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return b
+}
+
+// frameReader reads the payload of one message, which may span several
+// frames. It returns io.EOF after the final frame.
+type frameReader struct {
+	c   *wsconn
+	h   frameHeader
+	pos int64
+
+	// limit, if positive, fails a message with frames longer in total
+	limit int64
+	total int64
+}
+
+// checkLimit counts the current frame against fr.limit.
+func (fr *frameReader) checkLimit() error {
+	fr.total += fr.h.length
+	if fr.limit > 0 && fr.total > fr.limit {
+		fr.c.fail(closeTooBig, "message too big")
+		return errWSTooBig
+	}
+	return nil
+}
+
+func (fr *frameReader) Read(b []byte) (int, error) {
+	for fr.pos == fr.h.length {
+		if fr.h.fin {
+			return 0, io.EOF
+		}
+
+		h, payload, err := fr.c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch h.op {
+		case opContinuation:
+			fr.h, fr.pos = h, 0
+			if err := fr.checkLimit(); err != nil {
+				return 0, err
+			}
+		case opText, opBinary:
+			return 0, fmt.Errorf("websocket: expected a continuation frame")
+		default:
+			// control frames may be interleaved with fragments
+			if err := fr.c.handleControl(h, payload); err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			} else if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if rem := fr.h.length - fr.pos; int64(len(b)) > rem {
+		b = b[:rem]
+	}
+
+	n, err := fr.c.br.Read(b)
+	fr.h.unmask(b[:n], fr.pos)
+	fr.pos += int64(n)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// deflateMessage buffers a whole compressed message before inflating it.
+// Otherwise a read timeout would reach the inflater, which can't resume after
+// an error.
+type deflateMessage struct {
+	c   *wsconn
+	fr  *frameReader
+	buf bytes.Buffer
+	r   io.Reader
+}
+
+func (m *deflateMessage) Read(b []byte) (int, error) {
+	if m.r == nil {
+		if _, err := m.buf.ReadFrom(m.fr); err != nil {
+			return 0, err
+		}
+		m.r = m.c.deflate.reader(&m.buf)
+	}
+	return m.r.Read(b)
+}
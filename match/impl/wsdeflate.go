@@ -0,0 +1,274 @@
+package impl
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Deflate configures the permessage-deflate WebSocket extension (RFC 7692).
+type Deflate struct {
+	// Level is a compress/flate compression level.
+	// Zero selects flate.DefaultCompression.
+	Level int
+
+	// ServerNoContextTakeover makes the server reset its compressor after
+	// every message, which saves memory at the cost of compression ratio.
+	ServerNoContextTakeover bool
+
+	// ClientNoContextTakeover does the same for the client's compressor.
+	ClientNoContextTakeover bool
+}
+
+const deflateExtension = "permessage-deflate"
+
+// deflateWindow is the LZ77 window compress/flate always compresses with.
+// We can't compress with a smaller one, so we decline offers asking for it.
+const deflateWindow = 1 << 15
+
+// Appended to every compressed message before inflating. The first four bytes
+// are the tail stripped by the sender, the rest is an empty final block, which
+// makes the inflater end with io.EOF.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// offer returns the Sec-WebSocket-Extensions value a client sends.
+func (d Deflate) offer() string {
+	s := deflateExtension
+	if d.ServerNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if d.ClientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	return s
+}
+
+// accept picks the first acceptable permessage-deflate offer in a client's
+// request. It returns the response header value and the negotiated
+// parameters, or ok == false, if we should go on without compression.
+func (d Deflate) accept(h http.Header) (resp string, params deflateParams, ok bool) {
+	for _, ext := range parseExtensions(h) {
+		if ext.name != deflateExtension {
+			continue
+		}
+
+		params = deflateParams{
+			serverNoTakeover: d.ServerNoContextTakeover,
+			clientNoTakeover: d.ClientNoContextTakeover,
+		}
+
+		valid := true
+		for k, v := range ext.params {
+			switch k {
+			case "server_no_context_takeover":
+				params.serverNoTakeover = true
+			case "client_no_context_takeover":
+				params.clientNoTakeover = true
+			case "server_max_window_bits":
+				// we can only comply with the default window
+				if v != "15" {
+					valid = false
+				}
+			case "client_max_window_bits":
+				// the client may compress with any window we can inflate,
+				// so we don't need to limit it
+			default:
+				valid = false
+			}
+		}
+		if !valid {
+			continue
+		}
+
+		return params.String(), params, true
+	}
+
+	return "", deflateParams{}, false
+}
+
+// negotiated checks a server's response to our offer. ok is false if the
+// server declined the extension.
+func (d Deflate) negotiated(h http.Header) (params deflateParams, ok bool, err error) {
+	exts := parseExtensions(h)
+	if len(exts) == 0 {
+		return deflateParams{}, false, nil
+	}
+	if len(exts) > 1 || exts[0].name != deflateExtension {
+		return deflateParams{}, false, fmt.Errorf("websocket: unexpected extensions: %s", h.Get("Sec-WebSocket-Extensions"))
+	}
+
+	// whether the server resets its context is up to the server, ours is up
+	// to us
+	params = deflateParams{clientNoTakeover: d.ClientNoContextTakeover}
+
+	for k, v := range exts[0].params {
+		switch k {
+		case "server_no_context_takeover":
+			params.serverNoTakeover = true
+		case "client_no_context_takeover":
+			params.clientNoTakeover = true
+		case "server_max_window_bits":
+			// a smaller window of the server is fine for our inflater
+			if !validWindowBits(v) {
+				return deflateParams{}, false, fmt.Errorf("websocket: invalid server_max_window_bits %q", v)
+			}
+		default:
+			// client_max_window_bits wasn't offered, so it's not allowed here
+			return deflateParams{}, false, fmt.Errorf("websocket: unexpected extension parameter %s", k)
+		}
+	}
+
+	return params, true, nil
+}
+
+func validWindowBits(v string) bool {
+	switch v {
+	case "8", "9", "10", "11", "12", "13", "14", "15":
+		return true
+	}
+	return false
+}
+
+// deflateParams are the negotiated permessage-deflate parameters.
+type deflateParams struct {
+	serverNoTakeover bool
+	clientNoTakeover bool
+}
+
+func (p deflateParams) String() string {
+	s := deflateExtension
+	if p.serverNoTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.clientNoTakeover {
+		s += "; client_no_context_takeover"
+	}
+	return s
+}
+
+// conn creates the compression state for one side of a connection.
+func (p deflateParams) conn(client bool, level int) (*deflateConn, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	d := &deflateConn{}
+	if client {
+		d.writeTakeover = !p.clientNoTakeover
+		d.readTakeover = !p.serverNoTakeover
+	} else {
+		d.writeTakeover = !p.serverNoTakeover
+		d.readTakeover = !p.clientNoTakeover
+	}
+
+	var err error
+	d.fw, err = flate.NewWriter(&d.wbuf, level)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// deflateConn holds compressors of a single connection. compress is guarded by
+// the wsconn write lock, reader by the read lock.
+type deflateConn struct {
+	writeTakeover bool
+	fw            *flate.Writer
+	wbuf          bytes.Buffer
+
+	readTakeover bool
+	fr           io.ReadCloser
+	dict         []byte // recent inflated output, if readTakeover
+}
+
+// compress returns the payload of a compressed message. It's only valid until
+// the next call.
+func (d *deflateConn) compress(b []byte) ([]byte, error) {
+	d.wbuf.Reset()
+	if !d.writeTakeover {
+		d.fw.Reset(&d.wbuf)
+	}
+
+	if _, err := d.fw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := d.fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	// strip the empty stored block added by Flush, as RFC 7692 requires
+	out := d.wbuf.Bytes()
+	if !bytes.HasSuffix(out, deflateTail[:4]) {
+		return nil, fmt.Errorf("websocket: unexpected deflate output")
+	}
+	return out[:len(out)-4], nil
+}
+
+// reader inflates the payload of a compressed message read from r.
+func (d *deflateConn) reader(r io.Reader) io.Reader {
+	in := io.MultiReader(r, bytes.NewReader(deflateTail))
+
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(in, d.dict)
+	} else {
+		d.fr.(flate.Resetter).Reset(in, d.dict)
+	}
+
+	return inflateReader{d}
+}
+
+type inflateReader struct {
+	d *deflateConn
+}
+
+func (r inflateReader) Read(b []byte) (int, error) {
+	d := r.d
+	n, err := d.fr.Read(b)
+
+	if d.readTakeover && n > 0 {
+		// remember the window for the next message
+		d.dict = append(d.dict, b[:n]...)
+		if len(d.dict) > deflateWindow {
+			d.dict = append(d.dict[:0], d.dict[len(d.dict)-deflateWindow:]...)
+		}
+	}
+
+	return n, err
+}
+
+type extension struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions parses all Sec-WebSocket-Extensions headers.
+func parseExtensions(h http.Header) []extension {
+	exts := []extension{}
+
+	for _, line := range h[http.CanonicalHeaderKey("Sec-WebSocket-Extensions")] {
+		for _, elem := range strings.Split(line, ",") {
+			parts := strings.Split(elem, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+
+			ext := extension{name, map[string]string{}}
+			for _, p := range parts[1:] {
+				kv := strings.SplitN(p, "=", 2)
+				k := strings.TrimSpace(kv[0])
+				var v string
+				if len(kv) == 2 {
+					v = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+				}
+				ext.params[k] = v
+			}
+			exts = append(exts, ext)
+		}
+	}
+
+	return exts
+}
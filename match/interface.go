@@ -1,8 +1,10 @@
 package match
 
 import (
+	"errors"
 	ma "github.com/jbenet/go-multiaddr"
 	"net"
+	"strings"
 )
 
 type Matcher interface {
@@ -21,6 +23,12 @@ type MatchApplier interface {
 	Apply(m ma.Multiaddr, side int, ctx Context) error
 }
 
+// ProtocolLister is an optional interface of MatchAppliers, which tells what
+// protocol names (as in ma.Protocol.Name) they accept on the given side.
+type ProtocolLister interface {
+	Protocols(side int) []string
+}
+
 // Passed as an arg "side" to MatchAppliers.
 // Specifies whether we're dialing or listening.
 const (
@@ -35,13 +43,27 @@ type Context interface {
 	// help you experiment with new protocol implementations and whatever they
 	// need to pass between each other without the need (hopefully) to modify
 	// this library, at least until it's ready to merge.
+	//
+	// Deprecated: string keys collide easily, use a Key instead.
 	Map() map[string]interface{}
 
+	// Value and SetValue hold values under keys that are compared by
+	// identity. Use them through a typed Key rather than directly.
+	Value(key interface{}) interface{}
+	SetValue(key, val interface{})
+
 	// Holds useful info and objects. See struct definitions below.
 	Misc() *MiscContext
 	Special() *SpecialContext
 
-	// CopyTo shallow-copies contents to another context. Called by Reuse.
+	// CopyTo copies contents to another context. Called by Reuse.
+	//
+	// MiscContext is copied with MiscContext.Clone. SpecialContext is copied
+	// with SpecialContext.Clone, sharing the connection objects in it, since
+	// they're what's being reused.
+	// Values under Keys and in Map are copied with Clone if they implement
+	// Cloner, pointers are copied one level deep (i.e. to a copy of what they
+	// point to) and anything else is copied as is.
 	CopyTo(Context)
 
 	// A MatchApplier can offer its current context to be reused by another
@@ -53,6 +75,13 @@ type Context interface {
 	Reuse(mch Matcher)
 }
 
+// Cloner can be implemented by values stored in a Context to control how
+// CopyTo copies them. Clone should return a value of the same type, which
+// shares no mutable state with the original, unless that's intended.
+type Cloner interface {
+	Clone() interface{}
+}
+
 // MiscContext holds things produced by some MatchAppliers and required by others
 type MiscContext struct {
 	IPs     []net.IP
@@ -60,6 +89,19 @@ type MiscContext struct {
 	HTTPMux *ServeMux
 }
 
+// Clone returns a copy of m with its own IPs. HTTPMux is shared, because
+// reused contexts are meant to register handlers on the same ServeMux.
+func (m MiscContext) Clone() MiscContext {
+	if m.IPs != nil {
+		ips := make([]net.IP, len(m.IPs))
+		for i, ip := range m.IPs {
+			ips[i] = append(net.IP(nil), ip...)
+		}
+		m.IPs = ips
+	}
+	return m
+}
+
 // SpecialContext holds values that are used or written outside MatchApplier
 // objects by the library in between and after Apply() method calls.
 type SpecialContext struct {
@@ -77,10 +119,82 @@ type SpecialContext struct {
 	// during "http" Apply() execution PreAddr will be /ip4/127.0.0.1/tcp/80
 	PreAddr ma.Multiaddr
 
-	// CloseFn overrides the Close function of embedded NetConn and NetListener.
+	// GateTarget, if set, is called by MatchAppliers, which have a proxy
+	// connect somewhere on their behalf, with the target host (a name or an
+	// IP) before asking for it. An error refuses the target. Dial sets it to
+	// consult its Gater.
+	GateTarget func(host string) error
+
+	// CloseFn is run by Close before the close stack. The library moves it
+	// onto the stack after each Apply, so it's always nil when Apply starts,
+	// and chaining it, e.g. with impl.ConcatClose, chains nothing.
 	//
-	// If a MatchApplier needs to override this function, it should take the
-	// responsibility of calling the one written by a previous MatchApplier
-	// in the chain.
+	// Deprecated: push close functions with PushClose instead.
 	CloseFn func() error
+
+	// cleanup functions pushed by MatchAppliers, see PushClose
+	closers []func() error
+}
+
+// PushClose adds f to the close stack. MatchAppliers push whatever they need
+// to clean up, and the library runs the stack in reverse order when the
+// returned Conn or Listener is closed, or when a later MatchApplier fails.
+func (s *SpecialContext) PushClose(f func() error) {
+	s.closers = append(s.closers, f)
+}
+
+// Close runs and empties the close stack, last pushed first. It returns a
+// MultiError of everything that failed, or nil.
+func (s *SpecialContext) Close() error {
+	closers := s.TakeClose()
+	return closers()
+}
+
+// TakeClose empties the close stack and returns a function, which runs what
+// was in it. Reuse uses this to take over the cleanup of a shared context.
+func (s *SpecialContext) TakeClose() func() error {
+	closers := s.closers
+	if s.CloseFn != nil {
+		closers = append(closers[:len(closers):len(closers)], s.CloseFn)
+	}
+	s.closers = nil
+	s.CloseFn = nil
+
+	return func() error {
+		var errs MultiError
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i](); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) == 0 {
+			return nil
+		}
+		return errs
+	}
+}
+
+// Clone returns a copy of s with an empty close stack. The cleanup stays the
+// responsibility of the context that pushed it.
+func (s SpecialContext) Clone() SpecialContext {
+	s.closers = nil
+	s.CloseFn = nil
+	return s
+}
+
+// ErrHalfClose is returned by CloseRead and CloseWrite of connections, which
+// wrap one that can't close a single side.
+var ErrHalfClose = errors.New("half-close not supported")
+
+// MultiError aggregates errors of several operations, e.g. close functions.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
 }
+
+func (e MultiError) Unwrap() []error { return e }
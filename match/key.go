@@ -0,0 +1,31 @@
+package match
+
+// Key is a typed key for values that MatchAppliers pass to each other through
+// a Context. Keys are compared by identity, so two packages can't collide even
+// if they pick the same name. Create them once with NewKey, e.g.
+//
+//	var hostKey = match.NewKey[string]("example/host")
+//
+//	hostKey.Set(ctx, "example.com")
+//	host, ok := hostKey.Get(ctx)
+type Key[T any] struct {
+	name string
+}
+
+// NewKey returns a new unique Key. name is only used for debugging.
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name}
+}
+
+// Get returns the value stored under k in ctx, or ok == false if there's none.
+func (k *Key[T]) Get(ctx Context) (val T, ok bool) {
+	val, ok = ctx.Value(k).(T)
+	return
+}
+
+// Set stores val under k in ctx.
+func (k *Key[T]) Set(ctx Context, val T) {
+	ctx.SetValue(k, val)
+}
+
+func (k *Key[T]) String() string { return k.name }
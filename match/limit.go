@@ -0,0 +1,69 @@
+package match
+
+import (
+	"errors"
+	"sync"
+)
+
+// Limits on concurrent connections of a listener. Zero means no limit.
+type Limits struct {
+	// MaxConns limits open connections of a listener.
+	MaxConns int
+
+	// MaxConnsPerIP limits open connections from a single remote IP.
+	MaxConnsPerIP int
+}
+
+var (
+	ErrTooManyConns       = errors.New("too many connections")
+	ErrTooManyConnsFromIP = errors.New("too many connections from a single ip")
+)
+
+// ConnCounter counts open connections, in total and per remote IP. The zero
+// value is ready to use.
+type ConnCounter struct {
+	mu    sync.Mutex
+	total int
+	ips   map[string]int
+}
+
+// Acquire counts a connection from ip, unless that would exceed maxTotal or
+// maxPerIP, in which case it returns ErrTooManyConns or ErrTooManyConnsFromIP.
+// Zero maximums aren't checked. Each successful Acquire must be followed by a
+// Release.
+func (c *ConnCounter) Acquire(ip string, maxTotal, maxPerIP int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if maxTotal > 0 && c.total >= maxTotal {
+		return ErrTooManyConns
+	}
+	if maxPerIP > 0 && c.ips[ip] >= maxPerIP {
+		return ErrTooManyConnsFromIP
+	}
+
+	if c.ips == nil {
+		c.ips = map[string]int{}
+	}
+	c.total++
+	c.ips[ip]++
+	return nil
+}
+
+// Release uncounts a connection from ip.
+func (c *ConnCounter) Release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total--
+	if c.ips[ip]--; c.ips[ip] <= 0 {
+		delete(c.ips, ip)
+	}
+}
+
+// Total returns the number of open connections.
+func (c *ConnCounter) Total() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
@@ -0,0 +1,74 @@
+package manet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	lms := []string{
+		"/memory/plain",
+		"/memory/web/http/ws/foo",
+		"/memory/web/ws/bar", // reusing the http server of /memory/web
+	}
+
+	for _, s := range lms {
+		ln, err := Listen(newMultiaddr(t, s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go serveecho(ln)
+
+		m := newMultiaddr(t, strings.Replace(s, "/http/ws", "/ws", 1))
+		c, err := Dial(m)
+		if err != nil {
+			t.Fatalf("Dial(%s) err: %s", m, err)
+		}
+		assertEcho(t, c, m)
+	}
+
+	_, err := Listen(newMultiaddr(t, "/memory/plain"))
+	if err == nil || !strings.Contains(err.Error(), "taken") {
+		t.Errorf("expected a taken name error, got %v", err)
+	}
+
+	_, err = Dial(newMultiaddr(t, "/memory/nobody"))
+	if err == nil || !strings.Contains(err.Error(), "no listener") {
+		t.Errorf("expected a no listener error, got %v", err)
+	}
+}
+
+func TestMemoryAddrs(t *testing.T) {
+	ln, err := Listen(newMultiaddr(t, "/memory/addrs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Dial(newMultiaddr(t, "/memory/addrs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if !s.RemoteMultiaddr().Equal(c.LocalMultiaddr()) {
+		t.Errorf("expected %s, got %s", c.LocalMultiaddr(), s.RemoteMultiaddr())
+	}
+	if got := c.RemoteMultiaddr().String(); got != "/memory/addrs" {
+		t.Errorf("expected /memory/addrs, got %s", got)
+	}
+
+	// the name is free again after Close
+	ln.Close()
+	ln, err = Listen(newMultiaddr(t, "/memory/addrs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
@@ -0,0 +1,137 @@
+package manet
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// Names of metrics reported to a MetricsSink. Counters are reported with
+// MetricsSink.Count and histograms (durations in seconds) with
+// MetricsSink.Observe.
+const (
+	MetricDials        = "dials"         // counter, successful Dial calls
+	MetricDialErrors   = "dial_errors"   // counter, failed Dial calls
+	MetricDialLatency  = "dial_latency"  // histogram, duration of successful Dial calls
+	MetricListens      = "listens"       // counter, successful Listen calls
+	MetricAccepts      = "accepts"       // counter, connections returned by Accept, per listener
+	MetricBytesIn      = "bytes_in"      // counter, bytes read from a Conn
+	MetricBytesOut     = "bytes_out"     // counter, bytes written to a Conn
+	MetricConnDuration = "conn_duration" // histogram, time from Dial or Accept to Close
+)
+
+// MetricsSink receives metrics from Dial, Listen and the Conns and Listeners
+// they return. Each value is labelled by the protocol chain of the address it
+// concerns (e.g. "ip4/tcp/ws"), except MetricAccepts, which is labelled by
+// the multiaddr of the listener (e.g. "/ip4/0.0.0.0/tcp/80/ws/foo"), so that
+// listeners of the same chain are told apart. Methods may be called
+// concurrently.
+type MetricsSink interface {
+	// Count adds delta to the counter name.
+	Count(name, chain string, delta int64)
+
+	// Observe records a value of the histogram name.
+	Observe(name, chain string, value float64)
+}
+
+// SetMetrics makes Dial and Listen report into s. Conns and Listeners keep
+// reporting into the sink, which was set when they were created. A nil s
+// turns metrics off.
+func SetMetrics(s MetricsSink) {
+	matchers.Lock()
+	defer matchers.Unlock()
+
+	matchers.metrics = s
+}
+
+// chainLabel returns protocol names of m joined by slashes, e.g. "ip4/tcp/ws".
+func chainLabel(m ma.Multiaddr) string {
+	names := []string{}
+	for _, p := range m.Protocols() {
+		names = append(names, p.Name)
+	}
+	return strings.Join(names, "/")
+}
+
+// connMetrics reports byte counts and the lifetime of a conn.
+type connMetrics struct {
+	sink  MetricsSink
+	chain string
+	start time.Time
+	once  sync.Once
+}
+
+func newConnMetrics(sink MetricsSink, chain string) *connMetrics {
+	if sink == nil {
+		return nil
+	}
+	return &connMetrics{sink: sink, chain: chain, start: time.Now()}
+}
+
+func (cm *connMetrics) read(n int) {
+	if cm != nil && n > 0 {
+		cm.sink.Count(MetricBytesIn, cm.chain, int64(n))
+	}
+}
+
+func (cm *connMetrics) written(n int) {
+	if cm != nil && n > 0 {
+		cm.sink.Count(MetricBytesOut, cm.chain, int64(n))
+	}
+}
+
+func (cm *connMetrics) closed() {
+	if cm == nil {
+		return
+	}
+	cm.once.Do(func() {
+		cm.sink.Observe(MetricConnDuration, cm.chain, time.Since(cm.start).Seconds())
+	})
+}
+
+// MemMetrics is an in-memory MetricsSink, e.g. for tests.
+type MemMetrics struct {
+	mu         sync.Mutex
+	counters   map[memKey]int64
+	histograms map[memKey][]float64
+}
+
+type memKey struct {
+	name, chain string
+}
+
+func NewMemMetrics() *MemMetrics {
+	return &MemMetrics{
+		counters:   map[memKey]int64{},
+		histograms: map[memKey][]float64{},
+	}
+}
+
+func (mm *MemMetrics) Count(name, chain string, delta int64) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.counters[memKey{name, chain}] += delta
+}
+
+func (mm *MemMetrics) Observe(name, chain string, value float64) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	k := memKey{name, chain}
+	mm.histograms[k] = append(mm.histograms[k], value)
+}
+
+// Counter returns the current value of a counter.
+func (mm *MemMetrics) Counter(name, chain string) int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.counters[memKey{name, chain}]
+}
+
+// Histogram returns a copy of values observed for a histogram.
+func (mm *MemMetrics) Histogram(name, chain string) []float64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return append([]float64{}, mm.histograms[memKey{name, chain}]...)
+}
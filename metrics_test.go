@@ -0,0 +1,101 @@
+package manet
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	time.Sleep(toSleep)
+
+	lnMetrics, dialMetrics := NewMemMetrics(), NewMemMetrics()
+	defer SetMetrics(nil)
+
+	SetMetrics(lnMetrics)
+	ln, err := Listen(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/ws/foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// of the same chain, but its accepts are counted apart
+	other, err := Listen(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4326/ws/foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	SetMetrics(dialMetrics)
+	c, err := Dial(newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/ws/foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c.Close() // conn_duration is observed once
+	<-done
+
+	if _, err := Dial(newMultiaddr(t, "/ip4/127.0.0.1/tcp/1")); err == nil {
+		t.Fatal("expected a dial error")
+	}
+
+	chain := "ip4/tcp/ws"
+	assertCounters(t, "dial side", dialMetrics, chain, map[string]int64{
+		MetricDials:    1,
+		MetricBytesIn:  5,
+		MetricBytesOut: 5,
+	})
+	assertCounters(t, "dial side", dialMetrics, "ip4/tcp", map[string]int64{
+		MetricDialErrors: 1,
+	})
+	assertCounters(t, "listen side", lnMetrics, chain, map[string]int64{
+		MetricListens:  2,
+		MetricAccepts:  0,
+		MetricBytesIn:  5,
+		MetricBytesOut: 5,
+	})
+	assertCounters(t, "listen side", lnMetrics, "/ip4/127.0.0.1/tcp/4324/ws/foo", map[string]int64{
+		MetricAccepts: 1,
+	})
+	assertCounters(t, "listen side", lnMetrics, "/ip4/127.0.0.1/tcp/4326/ws/foo", map[string]int64{
+		MetricAccepts: 0,
+	})
+	assertCounters(t, "dial side", dialMetrics, "/ip4/127.0.0.1/tcp/4324/ws/foo", map[string]int64{
+		MetricAccepts: 0,
+	})
+
+	if n := len(dialMetrics.Histogram(MetricDialLatency, chain)); n != 1 {
+		t.Errorf("expected 1 dial latency, got %d", n)
+	}
+	for _, mm := range []*MemMetrics{dialMetrics, lnMetrics} {
+		if n := len(mm.Histogram(MetricConnDuration, chain)); n != 1 {
+			t.Errorf("expected 1 conn duration, got %d", n)
+		}
+	}
+}
+
+func assertCounters(t *testing.T, name string, mm *MemMetrics, chain string, expected map[string]int64) {
+	for metric, v := range expected {
+		if got := mm.Counter(metric, chain); got != v {
+			t.Errorf("%s: expected %s %s to be %d, got %d", name, chain, metric, v, got)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package manet
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/Gaboose/go-multiaddr-net/match"
 	"github.com/Gaboose/go-multiaddr-net/match/impl"
@@ -12,29 +15,67 @@ import (
 
 // Dial connects to a remote address
 func Dial(remote ma.Multiaddr) (Conn, error) {
+	return DialWithContext(remote, NewContext())
+}
+
+// DialWithContext is like Dial, but starts applying the chain to ctx, which
+// may hold options for MatchAppliers, e.g. under impl.TCPOptionsKey. ctx
+// should be fresh from NewContext and not be used for anything else.
+func DialWithContext(remote ma.Multiaddr, ctx match.Context) (_ Conn, err error) {
 
 	matchers.Lock()
 	defer matchers.Unlock()
 
+	sink, label, start := matchers.metrics, chainLabel(remote), time.Now()
+	defer func() {
+		if sink == nil {
+			return
+		}
+		if err != nil {
+			sink.Count(MetricDialErrors, label, 1)
+			return
+		}
+		sink.Count(MetricDials, label, 1)
+		sink.Observe(MetricDialLatency, label, time.Since(start).Seconds())
+	}()
+
+	gater := matchers.gater
+	if gater != nil && !gater.AllowDial(remote) {
+		return nil, &GatedError{remote, GateDial}
+	}
+
 	chain, split, err := matchers.buildChain(remote, match.S_Client)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx := NewContext()
 	sctx := ctx.Special()
+	var gated []net.IP
+	if gater != nil {
+		sctx.GateTarget = func(host string) error {
+			return gateTarget(gater, remote, host)
+		}
+	}
 
 	// apply context mutators
 	for i, mch := range chain {
 
-		err := mch.Apply(split[i], match.S_Client, ctx)
+		err := matchers.apply(mch, split[i], match.S_Client, ctx)
 		if err != nil {
-			if sctx.CloseFn != nil {
-				sctx.CloseFn()
-			}
+			sctx.Close()
 			return nil, err
 		}
 
+		// gate once the IPs to connect to are known, and again whenever a
+		// step replaces them, e.g. with the target of a proxy
+		if mctx := ctx.Misc(); gater != nil && len(mctx.IPs) > 0 && !sameIPs(mctx.IPs, gated) {
+			if err := gateResolved(gater, remote, mctx); err != nil {
+				sctx.Close()
+				return nil, err
+			}
+			gated = mctx.IPs
+		}
+
 		if sctx.PreAddr == nil {
 			sctx.PreAddr = split[i]
 		} else {
@@ -44,21 +85,26 @@ func Dial(remote ma.Multiaddr) (Conn, error) {
 	}
 
 	if sctx.NetConn == nil {
-		if sctx.CloseFn != nil {
-			sctx.CloseFn()
-		}
+		sctx.Close()
 		return nil, fmt.Errorf("insufficient address for a connection: %s", remote)
 	}
 
 	return &conn{
 		Conn:    sctx.NetConn,
 		raddr:   remote,
-		closeFn: sctx.CloseFn,
+		closeFn: sctx.Close,
+		metrics: newConnMetrics(sink, label),
 	}, nil
 }
 
 // Listen receives inbound connections on the local network address.
 func Listen(local ma.Multiaddr) (Listener, error) {
+	return ListenWithContext(local, NewContext())
+}
+
+// ListenWithContext is like Listen, but starts applying the chain to ctx, see
+// DialWithContext.
+func ListenWithContext(local ma.Multiaddr, ctx match.Context) (Listener, error) {
 	matchers.Lock()
 	defer matchers.Unlock()
 
@@ -68,18 +114,15 @@ func Listen(local ma.Multiaddr) (Listener, error) {
 		return nil, err
 	}
 
-	ctx := NewContext()
 	sctx := ctx.Special()
 
 	// apply chain to empty context
 	for i, mch := range chain {
 
-		err := mch.Apply(split[i], match.S_Server, ctx)
+		err := matchers.apply(mch, split[i], match.S_Server, ctx)
 
 		if err != nil {
-			if sctx.CloseFn != nil {
-				go sctx.CloseFn()
-			}
+			sctx.Close()
 			return nil, err
 		}
 
@@ -92,16 +135,22 @@ func Listen(local ma.Multiaddr) (Listener, error) {
 	}
 
 	if sctx.NetListener == nil {
-		if sctx.CloseFn != nil {
-			go sctx.CloseFn()
-		}
+		sctx.Close()
 		return nil, fmt.Errorf("insufficient address for a listener: %s", local)
 	}
 
 	ln := &listener{
 		Listener: sctx.NetListener,
 		maddr:    local,
-		closeFn:  sctx.CloseFn,
+		closeFn:  sctx.Close,
+		sink:     matchers.metrics,
+		chain:    chainLabel(local),
+		label:    local.String(),
+		gater:    matchers.gater,
+	}
+
+	if ln.sink != nil {
+		ln.sink.Count(MetricListens, ln.chain, 1)
 	}
 
 	return ln, nil
@@ -111,38 +160,130 @@ type listener struct {
 	net.Listener
 	maddr   ma.Multiaddr
 	closeFn func() error
+	closed  int32 // set atomically by Close
+
+	// metrics of the listener and its conns, sink may be nil
+	sink  MetricsSink
+	chain string
+	label string // of MetricAccepts, the listener's multiaddr
+
+	gater Gater // may be nil
+}
+
+// ErrListenerClosed is wrapped by the AcceptError returned from
+// Listener.Accept after the listener was closed.
+var ErrListenerClosed = errors.New("listener is closed")
+
+// AcceptError is returned by Listener.Accept. Err is either ErrListenerClosed,
+// a *GatedError or the error of the underlying net.Listener, whose Timeout and
+// Temporary methods are passed through, so the usual retry loops keep working.
+type AcceptError struct {
+	Addr ma.Multiaddr
+	Err  error
+}
+
+func (e *AcceptError) Error() string {
+	return fmt.Sprintf("accept %s: %s", e.Addr, e.Err)
+}
+
+func (e *AcceptError) Unwrap() error { return e.Err }
+
+func (e *AcceptError) Timeout() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Timeout()
 }
 
-func (l listener) Accept() (Conn, error) {
+func (e *AcceptError) Temporary() bool {
+	ne, ok := e.Err.(interface {
+		Temporary() bool
+	})
+	return ok && ne.Temporary()
+}
+
+func (l *listener) Accept() (Conn, error) {
 	netcon, err := l.Listener.Accept()
 	if err != nil {
-		return nil, fmt.Errorf("listener %s is closed", l.maddr.String())
+		if atomic.LoadInt32(&l.closed) != 0 {
+			err = ErrListenerClosed
+		}
+		return nil, &AcceptError{l.maddr, err}
 	}
 
-	return &conn{
+	c := &conn{
 		Conn:    netcon,
 		laddr:   l.maddr,
 		closeFn: netcon.Close,
-	}, nil
+	}
+
+	if l.gater != nil && !l.gater.AllowAccept(c) {
+		netcon.Close()
+		return nil, &AcceptError{l.maddr, &GatedError{c.RemoteMultiaddr(), GateAccept}}
+	}
+
+	if l.sink != nil {
+		l.sink.Count(MetricAccepts, l.label, 1)
+		c.metrics = newConnMetrics(l.sink, l.chain)
+	}
+
+	return c, nil
 }
 
-func (l listener) Close() error {
+func (l *listener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
 	return l.closeFn()
 }
 
-func (l listener) Multiaddr() ma.Multiaddr { return l.maddr }
+func (l *listener) Multiaddr() ma.Multiaddr { return l.maddr }
 
 type conn struct {
 	net.Conn
 	laddr   ma.Multiaddr
 	raddr   ma.Multiaddr
 	closeFn func() error
+	metrics *connMetrics // nil, if metrics are off
+}
+
+func (c conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.read(n)
+	return n, err
+}
+
+func (c conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.written(n)
+	return n, err
 }
 
 func (c conn) Close() error {
+	c.metrics.closed()
 	return c.closeFn()
 }
 
+// ErrHalfClose is returned by Conn.CloseRead and Conn.CloseWrite, if the
+// protocol chain doesn't support closing one side of a connection.
+//
+// It's the same error as match.ErrHalfClose, which MatchAppliers return.
+var ErrHalfClose = match.ErrHalfClose
+
+func (c conn) CloseRead() error {
+	if hc, ok := c.Conn.(interface {
+		CloseRead() error
+	}); ok {
+		return hc.CloseRead()
+	}
+	return ErrHalfClose
+}
+
+func (c conn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return hc.CloseWrite()
+	}
+	return ErrHalfClose
+}
+
 func (c conn) LocalMultiaddr() ma.Multiaddr {
 	if c.laddr != nil {
 		return c.laddr
@@ -158,6 +299,32 @@ func (c conn) RemoteMultiaddr() ma.Multiaddr {
 	return m
 }
 
+// PeerMultiaddr returns the address of the immediate peer of an accepted c. It
+// differs from RemoteMultiaddr, if a proxy told the client's address, e.g.
+// through /proxyproto or impl.WS.TrustedProxies. Otherwise, or for dialed
+// conns, it's RemoteMultiaddr.
+func PeerMultiaddr(c Conn) ma.Multiaddr {
+	if pc, ok := c.(interface {
+		PeerMultiaddr() ma.Multiaddr
+	}); ok {
+		return pc.PeerMultiaddr()
+	}
+	return c.RemoteMultiaddr()
+}
+
+func (c conn) PeerMultiaddr() ma.Multiaddr {
+	if c.raddr != nil {
+		return c.raddr
+	}
+	if pa, ok := c.Conn.(interface {
+		PeerAddr() net.Addr
+	}); ok {
+		m, _ := FromNetAddr(pa.PeerAddr())
+		return m
+	}
+	return c.RemoteMultiaddr()
+}
+
 func trimPrefix(m, prem ma.Multiaddr) (ma.Multiaddr, bool) {
 	s := m.String()
 	pres := prem.String()
@@ -171,9 +338,12 @@ func trimPrefix(m, prem ma.Multiaddr) (ma.Multiaddr, bool) {
 
 // FromNetAddr converts a net.Addr type to a Multiaddr.
 func FromNetAddr(naddr net.Addr) (ma.Multiaddr, error) {
-	if tcpaddr, ok := naddr.(*net.TCPAddr); ok {
-		return FromTCPAddr(tcpaddr)
-	} else {
+	switch a := naddr.(type) {
+	case *net.TCPAddr:
+		return FromTCPAddr(a)
+	case impl.MemoryAddr:
+		return ma.NewMultiaddr("/memory/" + string(a))
+	default:
 		return nil, fmt.Errorf("unknown net.Addr")
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"golang.org/x/net/websocket"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"runtime"
@@ -11,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Gaboose/go-multiaddr-net/match/impl"
 	ma "github.com/jbenet/go-multiaddr"
 )
 
@@ -243,6 +245,188 @@ func TestNumGoroutines(t *testing.T) {
 	assertNumGoroutines(t, baseNum)
 }
 
+func TestCloseWrite(t *testing.T) {
+	time.Sleep(toSleep)
+
+	ms := []ma.Multiaddr{
+		newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324"),
+		newMultiaddr(t, "/ip4/127.0.0.1/tcp/4326/ws/foo"),
+	}
+
+	for _, m := range ms {
+		ln, err := Listen(m)
+		if err != nil {
+			t.Errorf("Listen(%s) err: %s", m, err)
+			continue
+		}
+		defer ln.Close()
+
+		// reply only after the client is done writing
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			req, _ := ioutil.ReadAll(c)
+			fmt.Fprintf(c, "got %s", req)
+		}()
+
+		c, err := Dial(m)
+		if err != nil {
+			t.Errorf("Dial(%s) err: %s", m, err)
+			continue
+		}
+		defer c.Close()
+
+		fmt.Fprint(c, "request")
+		if err := c.CloseWrite(); err != nil {
+			t.Errorf("%s: CloseWrite err: %s", m, err)
+			continue
+		}
+
+		resp, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Errorf("%s: read err: %s", m, err)
+		} else if string(resp) != "got request" {
+			t.Errorf("%s: expected \"got request\", got \"%s\"", m, resp)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	time.Sleep(toSleep)
+
+	ms := []ma.Multiaddr{
+		newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324"),
+		newMultiaddr(t, "/ip4/127.0.0.1/tcp/4326/ws/foo"),
+	}
+
+	for _, m := range ms {
+		ln, err := Listen(m)
+		if err != nil {
+			t.Errorf("Listen(%s) err: %s", m, err)
+			continue
+		}
+		defer ln.Close()
+
+		accepted := make(chan Conn, 1)
+		go func() {
+			c, err := ln.Accept()
+			if err == nil {
+				accepted <- c
+			}
+		}()
+
+		dc, err := Dial(m)
+		if err != nil {
+			t.Errorf("Dial(%s) err: %s", m, err)
+			continue
+		}
+		defer dc.Close()
+
+		var ac Conn
+		select {
+		case ac = <-accepted:
+			defer ac.Close()
+		case <-time.After(time.Second):
+			t.Errorf("%s: Accept timed out", m)
+			continue
+		}
+
+		for _, side := range []struct {
+			name string
+			c    Conn
+		}{{"dial", dc}, {"accept", ac}} {
+			assertDeadline(t, fmt.Sprintf("%s %s", m, side.name), side.c)
+		}
+
+		// both ends should still be usable
+		go echoOnce(ac)
+		assertEcho(t, dc, m)
+	}
+}
+
+func assertDeadline(t *testing.T, name string, c Conn) {
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 16))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("%s: expected a read timeout, got %v", name, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("%s: read deadline was ignored", name)
+		c.Close()
+		return
+	}
+
+	c.SetWriteDeadline(time.Now().Add(-time.Second))
+	_, err := c.Write([]byte("x"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("%s: expected a write timeout, got %v", name, err)
+	}
+
+	c.SetDeadline(time.Time{})
+}
+
+func TestAcceptError(t *testing.T) {
+	time.Sleep(toSleep)
+
+	ms := []ma.Multiaddr{
+		newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324"),
+		newMultiaddr(t, "/ip4/127.0.0.1/tcp/4326/ws/foo"),
+	}
+
+	for _, m := range ms {
+		ln, err := Listen(m)
+		if err != nil {
+			t.Errorf("Listen(%s) err: %s", m, err)
+			continue
+		}
+		ln.Close()
+
+		_, err = ln.Accept()
+		if ae, ok := err.(*AcceptError); !ok || ae.Err != ErrListenerClosed {
+			t.Errorf("%s: expected ErrListenerClosed, got %v", m, err)
+		}
+	}
+
+	// errors of a listener that's still open are passed through
+	m := newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324")
+	ln := &listener{
+		Listener: failingListener{tempErr{}},
+		maddr:    m,
+	}
+	_, err := ln.Accept()
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() || !ne.Temporary() {
+		t.Errorf("expected a temporary timeout error, got %v", err)
+	}
+	if ae, ok := err.(*AcceptError); !ok || ae.Err != (tempErr{}) {
+		t.Errorf("expected the original error to be wrapped, got %v", err)
+	}
+}
+
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "temporary" }
+func (tempErr) Timeout() bool   { return true }
+func (tempErr) Temporary() bool { return true }
+
+type failingListener struct {
+	err error
+}
+
+func (l failingListener) Accept() (net.Conn, error) { return nil, l.err }
+func (l failingListener) Close() error              { return nil }
+func (l failingListener) Addr() net.Addr            { return nil }
+
 func newMultiaddr(t *testing.T, m string) ma.Multiaddr {
 	maddr, err := ma.NewMultiaddr(m)
 	if err != nil {
@@ -375,3 +559,117 @@ func assertNumGoroutines(t *testing.T, baseNum int) {
 		}
 	}
 }
+
+func TestNetem(t *testing.T) {
+	time.Sleep(toSleep)
+
+	defer Register(impl.Netem{Latency: 10 * time.Millisecond})()
+
+	for _, s := range []string{
+		"/memory/netem/x-netem/ws/foo",
+		"/ip4/127.0.0.1/tcp/4324/x-netem",
+	} {
+		m := newMultiaddr(t, s)
+		ln, err := Listen(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveecho(ln)
+
+		c, err := Dial(m)
+		if err != nil {
+			t.Fatalf("Dial(%s) err: %s", m, err)
+		}
+
+		// a write delayed on both ends
+		start := time.Now()
+		assertEcho(t, c, m)
+		if d := time.Since(start); d < 20*time.Millisecond {
+			t.Errorf("%s: expected a delay of at least 20ms, got %s", m, d)
+		}
+
+		ln.Close()
+	}
+}
+
+func TestWSOverWS(t *testing.T) {
+	m := newMultiaddr(t, "/memory/wsws/ws/outer/ws/inner")
+	ln, err := Listen(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveecho(ln)
+
+	dialed := make(chan error, 1)
+	go func() {
+		c, err := Dial(m)
+		if err == nil {
+			assertEcho(t, c, m)
+		}
+		dialed <- err
+	}()
+	select {
+	case err := <-dialed:
+		if err != nil {
+			t.Fatalf("Dial(%s) err: %s", m, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Dial(%s) timed out, nobody serves the inner /ws", m)
+	}
+
+	// the inner /ws is served inside the outer one, not next to it
+	inner := newMultiaddr(t, "/memory/wsws/ws/inner")
+	if c, err := Dial(inner); err == nil {
+		c.Close()
+		t.Errorf("expected Dial(%s) to fail", inner)
+	}
+}
+
+func TestPeerMultiaddr(t *testing.T) {
+	time.Sleep(toSleep)
+
+	loopback, err := ParseCIDRs("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Register(impl.ProxyProto{TrustedProxies: loopback})()
+
+	m := newMultiaddr(t, "/ip4/127.0.0.1/tcp/4324/proxyproto")
+	ln, err := Listen(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	netcon, err := net.Dial("tcp", "127.0.0.1:4324")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netcon.Close()
+	netcon.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 5678 4324\r\n"))
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if expected := newMultiaddr(t, "/ip4/192.0.2.1/tcp/5678"); !c.RemoteMultiaddr().Equal(expected) {
+		t.Errorf("expected RemoteMultiaddr %s, got %s", expected, c.RemoteMultiaddr())
+	}
+	peer, _ := FromNetAddr(netcon.LocalAddr())
+	if got := PeerMultiaddr(c); !got.Equal(peer) {
+		t.Errorf("expected PeerMultiaddr %s, got %s", peer, got)
+	}
+
+	// a dialed conn's peer is the address it dialed
+	dc, err := Dial(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	if got := PeerMultiaddr(dc); !got.Equal(m) {
+		t.Errorf("expected PeerMultiaddr %s of a dialed conn, got %s", m, got)
+	}
+}
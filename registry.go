@@ -2,6 +2,8 @@ package manet
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
 
 	"github.com/Gaboose/go-multiaddr-net/match"
@@ -18,16 +20,135 @@ type matchreg struct {
 
 	// running listeners available for reuse (e.g. /http with a ServeMux)
 	reusable []match.MatchApplier
+
+	// wrap every Apply call, see Intercept
+	interceptors []*interceptorEntry
+
+	// reported into by Dial and Listen, see SetMetrics
+	metrics MetricsSink
+
+	// consulted by Dial and Listen, see SetGater
+	gater Gater
+
+	// reuseMu guards reusable separately, so that a reusableContext can be
+	// closed while Dial or Listen hold the main lock, e.g. when a chain fails
+	reuseMu sync.Mutex
 }
 
-var matchers = &matchreg{
-	protocols: []match.MatchApplier{
+var matchers = &matchreg{protocols: standardProtocols()}
+
+func standardProtocols() []match.MatchApplier {
+	ps := []match.MatchApplier{
 		impl.IP{},
 		impl.DNS{},
 		impl.TCP{},
 		impl.HTTP{},
 		impl.WS{},
-	},
+		impl.Memory{},
+		impl.Netem{},
+		impl.Socks5{},
+		impl.HTTPConnect{},
+	}
+
+	// the vendored go-multiaddr can't decode /onion without
+	// patches/go-multiaddr-onion.patch
+	if impl.OnionSupported() {
+		ps = append(ps, impl.Onion{})
+	}
+
+	return append(ps, impl.ProxyProto{})
+}
+
+// Register adds p to the standard MatchAppliers used by Dial and Listen.
+// If a MatchApplier of the same type is already registered, p replaces it,
+// which is also the way to configure the standard ones. E.g.
+//
+//	manet.Register(impl.WS{Compression: &impl.Deflate{}})
+//
+// Calling the returned function puts back what p replaced, or removes p if it
+// replaced nothing, e.g. to undo a configuration at the end of a test.
+func Register(p match.MatchApplier) (restore func()) {
+	matchers.Lock()
+	defer matchers.Unlock()
+
+	t := reflect.TypeOf(p)
+	prev := matchers.register(p)
+
+	return func() {
+		matchers.Lock()
+		defer matchers.Unlock()
+
+		if prev != nil {
+			matchers.register(prev)
+			return
+		}
+		for i, mch := range matchers.protocols {
+			if reflect.TypeOf(mch) == t {
+				matchers.protocols = append(matchers.protocols[:i], matchers.protocols[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// register adds p or replaces the MatchApplier of its type, which it returns.
+func (mr *matchreg) register(p match.MatchApplier) match.MatchApplier {
+	t := reflect.TypeOf(p)
+	for i, mch := range mr.protocols {
+		if reflect.TypeOf(mch) == t {
+			mr.protocols[i] = p
+			return mch
+		}
+	}
+
+	mr.protocols = append(mr.protocols, p)
+	return nil
+}
+
+// CanDial reports whether Dial would find a MatchApplier for every part of m.
+// Nothing is applied, so a dial may still fail, e.g. if the address is
+// unreachable or insufficient for a connection.
+func CanDial(m ma.Multiaddr) bool {
+	return canHandle(m, match.S_Client)
+}
+
+// CanListen is like CanDial, but for Listen.
+func CanListen(m ma.Multiaddr) bool {
+	return canHandle(m, match.S_Server)
+}
+
+func canHandle(m ma.Multiaddr, side int) bool {
+	matchers.Lock()
+	defer matchers.Unlock()
+
+	_, _, err := matchers.buildChain(m, side)
+	return err == nil
+}
+
+// SupportedProtocols returns sorted names of protocols, which the standard
+// MatchAppliers accept on the given side. Only MatchAppliers implementing
+// match.ProtocolLister are taken into account.
+func SupportedProtocols(side int) []string {
+	matchers.Lock()
+	defer matchers.Unlock()
+
+	seen := map[string]bool{}
+	names := []string{}
+	for _, mch := range matchers.protocols {
+		pl, ok := mch.(match.ProtocolLister)
+		if !ok {
+			continue
+		}
+		for _, name := range pl.Protocols(side) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names
 }
 
 type reusableContext struct {
@@ -38,34 +159,42 @@ type reusableContext struct {
 }
 
 func (rc *reusableContext) Apply(m ma.Multiaddr, side int, ctx match.Context) error {
+	matchers.reuseMu.Lock()
+	defer matchers.reuseMu.Unlock()
+
+	if rc.usecount == 0 {
+		return fmt.Errorf("reusable context for %s is closed", m)
+	}
+
 	rc.Context.CopyTo(ctx)
-	ctx.Special().CloseFn = rc.Close
+	ctx.Special().PushClose(rc.Close)
 	rc.usecount++
 	return nil
 }
 
 func (rc *reusableContext) Close() error {
-	matchers.Lock()
-	defer matchers.Unlock()
+	matchers.reuseMu.Lock()
 
 	rc.usecount--
-	if rc.usecount == 0 {
+	if rc.usecount != 0 {
+		matchers.reuseMu.Unlock()
+		return nil
+	}
 
-		// remove rc from matchers.reusable
-		mr := matchers.reusable
-		for i, mch := range mr {
-			if mch == rc {
-				mr[i] = mr[len(mr)-1] // override with the last element
-				mr[len(mr)-1] = nil   // remove duplicate ref
-				mr = mr[:len(mr)-1]   // decrease length by one
-				break
-			}
+	// remove rc from matchers.reusable
+	mr := matchers.reusable
+	for i, mch := range mr {
+		if mch == rc {
+			mr[i] = mr[len(mr)-1] // override with the last element
+			mr[len(mr)-1] = nil   // remove duplicate ref
+			mr = mr[:len(mr)-1]   // decrease length by one
+			break
 		}
-		matchers.reusable = mr
-
-		return rc.underClose()
 	}
-	return nil
+	matchers.reusable = mr
+	matchers.reuseMu.Unlock()
+
+	return rc.underClose()
 }
 
 // buildChain returns two parralel slices. One holds a sequence of MatchAppliers,
@@ -74,15 +203,17 @@ func (rc *reusableContext) Close() error {
 // is what each MatchApplier.Apply expects as its m argument.
 //
 // Allowed values for side are match.S_Server and match.S_Client.
-func (mr matchreg) buildChain(m ma.Multiaddr, side int) ([]match.MatchApplier, []ma.Multiaddr, error) {
+//
+// On error, the slices hold what was matched before the failure.
+func (mr *matchreg) buildChain(m ma.Multiaddr, side int) ([]match.MatchApplier, []ma.Multiaddr, error) {
 	tail := m
 	chain := []match.MatchApplier{}
 	split := []ma.Multiaddr{}
 
-	for tail.String() != "" {
+	for len(tail.Bytes()) > 0 {
 		mch, n, err := mr.matchPrefix(tail, side)
 		if err != nil {
-			return nil, nil, err
+			return chain, split, err
 		}
 
 		spl := ma.Split(tail)
@@ -102,14 +233,16 @@ func (mr matchreg) buildChain(m ma.Multiaddr, side int) ([]match.MatchApplier, [
 //
 // matchPrefix returns an error if it can't find any or finds more than one
 // MatchApplier
-func (mr matchreg) matchPrefix(m ma.Multiaddr, side int) (match.MatchApplier, int, error) {
+func (mr *matchreg) matchPrefix(m ma.Multiaddr, side int) (match.MatchApplier, int, error) {
 	ret := []match.MatchApplier{}
 
+	mr.reuseMu.Lock()
 	for _, mch := range mr.reusable {
 		if _, ok := mch.Match(m, side); ok {
 			ret = append(ret, mch)
 		}
 	}
+	mr.reuseMu.Unlock()
 
 	if len(ret) == 1 {
 		n, _ := ret[0].Match(m, side)
@@ -0,0 +1,91 @@
+package manet
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Gaboose/go-multiaddr-net/match"
+	"github.com/Gaboose/go-multiaddr-net/match/impl"
+)
+
+func TestCanDialListen(t *testing.T) {
+	cases := []struct {
+		m      string
+		dial   bool
+		listen bool
+	}{
+		{"/ip4/127.0.0.1/tcp/4324", true, true},
+		{"/dns/localhost/tcp/4324/ws/foo", true, true},
+		{"/ip4/127.0.0.1/tcp/4324/http/ws/foo", true, true},
+		{"/ip4/127.0.0.1/tcp/4324/http", false, true},
+		{"/ip4/127.0.0.1/udp/4324", false, false},
+		{"/ip4/127.0.0.1/tcp/1080/socks5/dns/example.com/tcp/80/ws/foo", true, false},
+		{"/ip4/127.0.0.1/tcp/1080/socks5/ws/foo", false, false},
+		{"/dns/proxy/tcp/3128/http-connect/ip4/127.0.0.1/tcp/80", true, false},
+		{"/onion/timaq4ygg2iegci7:80/http/ws/foo", true, false},
+		{"/ip4/127.0.0.1/tcp/4324/proxyproto/http/ws/foo", true, true},
+	}
+
+	for _, c := range cases {
+		if strings.HasPrefix(c.m, "/onion") && !impl.OnionSupported() {
+			continue
+		}
+		m := newMultiaddr(t, c.m)
+		if got := CanDial(m); got != c.dial {
+			t.Errorf("CanDial(%s) = %v, expected %v", m, got, c.dial)
+		}
+		if got := CanListen(m); got != c.listen {
+			t.Errorf("CanListen(%s) = %v, expected %v", m, got, c.listen)
+		}
+	}
+}
+
+func TestSupportedProtocols(t *testing.T) {
+	got := strings.Join(SupportedProtocols(match.S_Client), " ")
+	expected := "dns http http-connect ip ip4 ip6 memory onion proxyproto socks5 tcp ws x-netem"
+	if !impl.OnionSupported() {
+		expected = strings.Replace(expected, " onion", "", 1)
+	}
+	if got != expected {
+		t.Errorf("expected client protocols %q, got %q", expected, got)
+	}
+
+	got = strings.Join(SupportedProtocols(match.S_Server), " ")
+	if expected = "dns http ip ip4 ip6 memory proxyproto tcp ws x-netem"; got != expected {
+		t.Errorf("expected server protocols %q, got %q", expected, got)
+	}
+}
+
+func TestRegisterRestore(t *testing.T) {
+	registered := func(typ interface{}) match.MatchApplier {
+		matchers.Lock()
+		defer matchers.Unlock()
+		for _, mch := range matchers.protocols {
+			if reflect.TypeOf(mch) == reflect.TypeOf(typ) {
+				return mch
+			}
+		}
+		return nil
+	}
+
+	prev := registered(impl.WS{})
+	restore := Register(impl.WS{Backlog: 7})
+	if ws, ok := registered(impl.WS{}).(impl.WS); !ok || ws.Backlog != 7 {
+		t.Fatalf("expected the new WS to be registered, got %#v", registered(impl.WS{}))
+	}
+	restore()
+	if !reflect.DeepEqual(registered(impl.WS{}), prev) {
+		t.Errorf("expected the previous WS back, got %#v", registered(impl.WS{}))
+	}
+
+	// a new type is removed
+	restore = Register(legacyCloser{})
+	if registered(legacyCloser{}) == nil {
+		t.Fatal("expected a new type to be registered")
+	}
+	restore()
+	if registered(legacyCloser{}) != nil {
+		t.Error("expected a new type to be removed")
+	}
+}
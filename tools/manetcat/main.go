@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	manet "github.com/Gaboose/go-multiaddr-net"
+	"github.com/Gaboose/go-multiaddr-net/match"
 	ma "github.com/jbenet/go-multiaddr"
 	"io"
 	lg "log"
@@ -14,7 +15,7 @@ var log = lg.New(os.Stdout, "", lg.Lshortfile)
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [-l] <multiaddr>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [-l] [-explain] <multiaddr>\n", os.Args[0])
 		flag.PrintDefaults()
 		fmt.Fprintln(os.Stderr, "Examples:")
 		fmt.Fprintf(os.Stderr, "	%s -l /ip4/0.0.0.0/tcp/4324\n", os.Args[0])
@@ -25,6 +26,7 @@ func init() {
 
 func main() {
 	listen := flag.Bool("l", false, "listen mode, for inbound connections")
+	explain := flag.Bool("explain", false, "print how the multiaddr would be handled and exit")
 	flag.Parse()
 
 	args := flag.Args()
@@ -38,6 +40,19 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *explain {
+		side := match.S_Client
+		if *listen {
+			side = match.S_Server
+		}
+		e, err := manet.Explain(m, side)
+		fmt.Print(e)
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	var c manet.Conn
 	if *listen {
 		ln, err := manet.Listen(m)
@@ -56,6 +71,10 @@ func main() {
 		}
 	}
 
-	go io.Copy(c, os.Stdin)
+	go func() {
+		io.Copy(c, os.Stdin)
+		// let the peer know we're done, but keep reading its output
+		c.CloseWrite()
+	}()
 	io.Copy(os.Stdout, c)
 }